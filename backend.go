@@ -9,6 +9,11 @@ import (
 
 type Backend interface {
 	Get(key string) (string, error)
+
+	// GetIndex is like Get, but it also returns the key's modification index
+	// (for use with CompareAndSwap and CompareAndDelete).
+	GetIndex(key string) (value string, index uint64, err error)
+
 	List(key string, recursive bool) ([]string, error)
 
 	// ListKeys lists only keys (not directories).
@@ -18,9 +23,123 @@ type Backend interface {
 	SetDir(key string, ttl uint64) error
 	UpdateDir(key string, ttl uint64) error
 	Delete(key string) error
+
+	// DeleteDir deletes the directory at key and everything beneath it.
+	DeleteDir(key string) error
+
+	// Create sets key to value only if key does not already exist. If it
+	// does, ErrKeyExists is returned. If ttl is nonzero, key is deleted after
+	// ttl seconds. Create returns the new modification index of key.
+	Create(key, value string, ttl uint64) (index uint64, err error)
+
+	// CompareAndSwap sets key to value (with a ttl, as in Create) only if
+	// key's modification index is prevIndex. If not, ErrCompareFailed is
+	// returned (or ErrKeyNotExist, if key does not exist). CompareAndSwap
+	// returns the new modification index of key.
+	CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error)
+
+	// CompareAndDelete deletes key only if its modification index is
+	// prevIndex. If not, ErrCompareFailed is returned (or ErrKeyNotExist, if
+	// key does not exist).
+	CompareAndDelete(key string, prevIndex uint64) error
+
+	// Watch sends each change to key (and, if recursive, to keys beneath it)
+	// on events until stop is closed. If waitIndex is nonzero, changes
+	// starting at that index are sent, which lets callers resume an earlier
+	// watch; otherwise only changes made after Watch is called are sent. If
+	// waitIndex is too old to resume from, ErrWatchIndexCleared is returned.
+	// Watch closes events before returning.
+	Watch(key string, waitIndex uint64, recursive bool, events chan<- *WatchEvent, stop <-chan struct{}) error
+}
+
+var (
+	ErrKeyNotExist = errors.New("key does not exist")
+	ErrKeyExists   = errors.New("key already exists")
+
+	// ErrCompareFailed is returned by CompareAndSwap and CompareAndDelete
+	// when the key was modified after the given index.
+	ErrCompareFailed = errors.New("key was modified concurrently (compare failed)")
+)
+
+// A WatchEvent describes a change to a key in a Backend.
+type WatchEvent struct {
+	Action WatchAction
+
+	// Key is the key that changed (without the backend's key prefix).
+	Key string
+
+	// Value is the key's new value. It is empty for directories and for
+	// deletions.
+	Value string
+
+	Dir bool
+
+	// Index is the backend's modification index of this change. To resume
+	// watching after this event, pass Index+1 as the waitIndex to Watch.
+	Index uint64
+}
+
+// A WatchAction is the type of change that a WatchEvent describes.
+type WatchAction string
+
+const (
+	WatchSet    WatchAction = "set"    // key was created or overwritten
+	WatchUpdate WatchAction = "update" // existing key was modified in place
+	WatchDelete WatchAction = "delete" // key was deleted
+	WatchExpire WatchAction = "expire" // key's TTL elapsed
+)
+
+// ErrWatchIndexCleared is returned by Watch when the requested waitIndex is
+// older than the oldest change that the backend still remembers.
+var ErrWatchIndexCleared = errors.New("watch index has been cleared from the event history")
+
+// A TxnBackend is a Backend that can apply several changes atomically.
+// MemoryBackend, FileBackend, and EtcdV3Backend implement it; EtcdBackend
+// does not, because the etcd v2 API has no multi-key transactions.
+type TxnBackend interface {
+	Backend
+
+	// Txn applies all of ops, or none of them. If any op's condition does
+	// not hold, nothing is changed and that op's error is returned (as
+	// returned by the corresponding single-key Backend method, e.g.,
+	// ErrKeyExists for a TxnCreate of an existing key). Each key may appear
+	// in at most one op.
+	Txn(ops []TxnOp) error
+}
+
+// An IndexBackend is a Backend that can report its current modification
+// index, so that callers can read keys and then watch for exactly the
+// changes made after they were read. All of this package's backends
+// implement it.
+type IndexBackend interface {
+	Backend
+
+	// Index returns the backend's current modification index. Changes made
+	// after Index returns have greater indexes, so a Watch with a waitIndex
+	// of Index()+1 sends all of them.
+	Index() (uint64, error)
 }
 
-var ErrKeyNotExist = errors.New("key does not exist")
+// A TxnOp is a single change in a transaction.
+type TxnOp struct {
+	Type  TxnOpType
+	Key   string
+	Value string // for TxnCreate and TxnSet
+
+	// PrevIndex is the modification index that the key must have (for
+	// TxnCompareAndDelete).
+	PrevIndex uint64
+}
+
+// A TxnOpType is the type of change that a TxnOp makes.
+type TxnOpType int
+
+const (
+	TxnCreate           TxnOpType = iota // create key, which must not exist
+	TxnSet                               // set key, creating it if needed
+	TxnDelete                            // delete key, which must exist
+	TxnCompareAndDelete                  // delete key if its index is PrevIndex
+)
 
 type EtcdBackend struct {
 	keyPrefix string
@@ -43,6 +162,17 @@ func (c *EtcdBackend) Get(key string) (string, error) {
 	return resp.Node.Value, nil
 }
 
+func (c *EtcdBackend) GetIndex(key string) (string, uint64, error) {
+	key = c.fullKey(key)
+	resp, err := c.etcd.Get(key, false, false)
+	if isEtcdKeyNotExist(err) {
+		return "", 0, ErrKeyNotExist
+	} else if err != nil {
+		return "", 0, err
+	}
+	return resp.Node.Value, resp.Node.ModifiedIndex, nil
+}
+
 func (c *EtcdBackend) ListKeys(key string, recursive bool) ([]string, error) {
 	return c.listNames(key, recursive, true)
 }
@@ -102,21 +232,150 @@ func (c *EtcdBackend) Set(key, value string) error {
 func (c *EtcdBackend) SetDir(key string, ttl uint64) error {
 	key = c.fullKey(key)
 	_, err := c.etcd.SetDir(key, ttl)
+	if isEtcdErrorCode(err, 102) || isEtcdErrorCode(err, 105) {
+		return ErrKeyExists
+	}
 	return err
 }
 
 func (c *EtcdBackend) UpdateDir(key string, ttl uint64) error {
 	key = c.fullKey(key)
 	_, err := c.etcd.UpdateDir(key, ttl)
+	if isEtcdKeyNotExist(err) {
+		return ErrKeyNotExist
+	}
 	return err
 }
 
 func (c *EtcdBackend) Delete(key string) error {
 	key = c.fullKey(key)
 	_, err := c.etcd.Delete(key, false)
+	if isEtcdKeyNotExist(err) {
+		return ErrKeyNotExist
+	}
 	return err
 }
 
+func (c *EtcdBackend) DeleteDir(key string) error {
+	key = c.fullKey(key)
+	_, err := c.etcd.Delete(key, true)
+	if isEtcdKeyNotExist(err) {
+		return ErrKeyNotExist
+	}
+	return err
+}
+
+func (c *EtcdBackend) Create(key, value string, ttl uint64) (uint64, error) {
+	key = c.fullKey(key)
+	resp, err := c.etcd.Create(key, value, ttl)
+	if isEtcdErrorCode(err, 105) {
+		return 0, ErrKeyExists
+	} else if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (c *EtcdBackend) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (uint64, error) {
+	key = c.fullKey(key)
+	resp, err := c.etcd.CompareAndSwap(key, value, ttl, "", prevIndex)
+	if err != nil {
+		return 0, etcdCompareError(err)
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (c *EtcdBackend) CompareAndDelete(key string, prevIndex uint64) error {
+	key = c.fullKey(key)
+	_, err := c.etcd.CompareAndDelete(key, "", prevIndex)
+	return etcdCompareError(err)
+}
+
+func etcdCompareError(err error) error {
+	if isEtcdKeyNotExist(err) {
+		return ErrKeyNotExist
+	} else if isEtcdErrorCode(err, 101) {
+		return ErrCompareFailed
+	}
+	return err
+}
+
+func (c *EtcdBackend) Watch(key string, waitIndex uint64, recursive bool, events chan<- *WatchEvent, stop <-chan struct{}) error {
+	defer close(events)
+
+	recv := make(chan *etcd.Response, 10)
+	stopWatch := make(chan bool, 1)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.etcd.Watch(c.fullKey(key), waitIndex, recursive, recv, stopWatch)
+		errc <- err
+	}()
+
+	// stopped stops the etcd watch and waits for it to finish. The etcd client
+	// closes recv when its watch returns.
+	stopped := func() error {
+		stopWatch <- true
+		for range recv {
+		}
+		<-errc
+		return nil
+	}
+
+	for {
+		select {
+		case resp, ok := <-recv:
+			if !ok {
+				err := <-errc
+				if err == etcd.ErrWatchStoppedByUser {
+					return nil
+				} else if isEtcdErrorCode(err, 401) {
+					return ErrWatchIndexCleared
+				}
+				return err
+			}
+			select {
+			case events <- c.watchEvent(resp):
+			case <-stop:
+				return stopped()
+			}
+		case <-stop:
+			return stopped()
+		}
+	}
+}
+
+func (c *EtcdBackend) watchEvent(resp *etcd.Response) *WatchEvent {
+	var action WatchAction
+	switch resp.Action {
+	case "update", "compareAndSwap":
+		action = WatchUpdate
+	case "delete", "compareAndDelete":
+		action = WatchDelete
+	case "expire":
+		action = WatchExpire
+	default:
+		action = WatchSet
+	}
+	return &WatchEvent{
+		Action: action,
+		Key:    keyPathJoin(strings.TrimPrefix(resp.Node.Key, trailingSlash(c.keyPrefix))),
+		Value:  resp.Node.Value,
+		Dir:    resp.Node.Dir,
+		Index:  resp.Node.ModifiedIndex,
+	}
+}
+
+func (c *EtcdBackend) Index() (uint64, error) {
+	resp, err := c.etcd.Get(c.fullKey("/"), false, false)
+	if isEtcdKeyNotExist(err) {
+		// The error still carries the current index.
+		return err.(*etcd.EtcdError).Index, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return resp.EtcdIndex, nil
+}
+
 func (c *EtcdBackend) fullKey(keyWithoutPrefix string) string {
 	return keyPathJoin(c.keyPrefix, keyWithoutPrefix)
 }
@@ -3,6 +3,7 @@ package datad
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func testBackend(t *testing.T, b Backend) {
@@ -65,4 +66,213 @@ func testBackend(t *testing.T, b Backend) {
 	if err != ErrKeyNotExist {
 		t.Error(err)
 	}
+
+	// DeleteDir
+	must(t, b.Set("dir2/sub/key", "v"))
+	must(t, b.DeleteDir("dir2"))
+	if _, err := b.Get("dir2/sub/key"); err != ErrKeyNotExist {
+		t.Errorf("got Get error %v after DeleteDir, want ErrKeyNotExist", err)
+	}
+	if err := b.DeleteDir("dir2"); err != ErrKeyNotExist {
+		t.Errorf("got DeleteDir error %v, want ErrKeyNotExist", err)
+	}
+}
+
+func testBackendWatch(t *testing.T, b Backend) {
+	events := make(chan *WatchEvent, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- b.Watch("w", 0, true, events, stop) }()
+
+	// Give the watch time to start, since only changes made after Watch is
+	// called are sent.
+	time.Sleep(100 * time.Millisecond)
+
+	must(t, b.Set("w/a/b", "1"))
+	must(t, b.Delete("w/a/b"))
+
+	var got []WatchEvent
+	for len(got) < 2 {
+		ev := <-events
+		if ev.Dir {
+			// Backends differ in whether they report the implicit creation
+			// of parent directories.
+			continue
+		}
+		got = append(got, *ev)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if got[0].Action != WatchSet || got[0].Key != "/w/a/b" || got[0].Value != "1" {
+		t.Errorf("got event %+v, want set of /w/a/b", got[0])
+	}
+	if got[1].Action != WatchDelete || got[1].Key != "/w/a/b" || got[1].Index <= got[0].Index {
+		t.Errorf("got event %+v, want later delete of /w/a/b", got[1])
+	}
+
+	// Resume from the first event's index.
+	events = make(chan *WatchEvent, 10)
+	stop = make(chan struct{})
+	go func() { done <- b.Watch("w/a/b", got[0].Index, false, events, stop) }()
+	if ev := <-events; ev.Index != got[0].Index || ev.Action != WatchSet {
+		t.Errorf("got resumed event %+v, want %+v", ev, got[0])
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Watching from after the current index sends the changes made after
+	// it, even those made before Watch is called.
+	ib, ok := b.(IndexBackend)
+	if !ok {
+		t.Fatalf("backend %T doesn't implement IndexBackend", b)
+	}
+	index, err := ib.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index < got[1].Index {
+		t.Errorf("got Index == %d, want at least %d", index, got[1].Index)
+	}
+	must(t, b.Set("w/c", "2"))
+	events = make(chan *WatchEvent, 10)
+	stop = make(chan struct{})
+	go func() { done <- b.Watch("w/c", index+1, false, events, stop) }()
+	if ev := <-events; ev.Key != "/w/c" || ev.Action != WatchSet {
+		t.Errorf("got event %+v, want set of /w/c", ev)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBackendDirTTL(t *testing.T, b Backend, ttl uint64) {
+	must(t, b.SetDir("nodes/n", ttl))
+	must(t, b.Set("nodes/n/info", "x"))
+
+	if err := b.SetDir("nodes/n", ttl); err != ErrKeyExists {
+		t.Errorf("got SetDir error %v, want ErrKeyExists", err)
+	}
+	must(t, b.UpdateDir("nodes/n", ttl))
+
+	nodes, err := b.List("nodes", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"n"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got List == %v, want %v", nodes, want)
+	}
+
+	// Sleep so that the TTL elapses.
+	time.Sleep(time.Duration(ttl)*time.Second + 500*time.Millisecond)
+
+	nodes, err = b.List("nodes", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("got List == %v, want empty", nodes)
+	}
+	if _, err := b.Get("nodes/n/info"); err != ErrKeyNotExist {
+		t.Errorf("got Get error %v, want ErrKeyNotExist", err)
+	}
+	if err := b.UpdateDir("nodes/n", ttl); err != ErrKeyNotExist {
+		t.Errorf("got UpdateDir error %v, want ErrKeyNotExist", err)
+	}
+}
+
+func testBackendCompareAndSwap(t *testing.T, b Backend) {
+	// Create
+	index, err := b.Create("cas/key", "v0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Create("cas/key", "v1", 0); err != ErrKeyExists {
+		t.Errorf("got Create error %v, want ErrKeyExists", err)
+	}
+	v, index2, err := b.GetIndex("cas/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "v0" || index2 != index {
+		t.Errorf("got GetIndex == %q, %d, want %q, %d", v, index2, "v0", index)
+	}
+
+	// CompareAndSwap
+	newIndex, err := b.CompareAndSwap("cas/key", "v1", 0, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newIndex <= index {
+		t.Errorf("got new index %d, want > %d", newIndex, index)
+	}
+	if _, err := b.CompareAndSwap("cas/key", "v2", 0, index); err != ErrCompareFailed {
+		t.Errorf("got stale CompareAndSwap error %v, want ErrCompareFailed", err)
+	}
+	if _, err := b.CompareAndSwap("cas/nokey", "v", 0, index); err != ErrKeyNotExist {
+		t.Errorf("got CompareAndSwap (nonexistent key) error %v, want ErrKeyNotExist", err)
+	}
+	if v, err := b.Get("cas/key"); err != nil || v != "v1" {
+		t.Errorf("got Get == %q, %v, want %q", v, err, "v1")
+	}
+
+	// CompareAndDelete
+	if err := b.CompareAndDelete("cas/key", index); err != ErrCompareFailed {
+		t.Errorf("got stale CompareAndDelete error %v, want ErrCompareFailed", err)
+	}
+	must(t, b.CompareAndDelete("cas/key", newIndex))
+	if err := b.CompareAndDelete("cas/key", newIndex); err != ErrKeyNotExist {
+		t.Errorf("got CompareAndDelete (deleted key) error %v, want ErrKeyNotExist", err)
+	}
+	if _, err := b.Get("cas/key"); err != ErrKeyNotExist {
+		t.Errorf("got Get error %v, want ErrKeyNotExist", err)
+	}
+}
+
+func testBackendTxn(t *testing.T, b TxnBackend) {
+	must(t, b.Txn([]TxnOp{
+		{Type: TxnCreate, Key: "txn/a/x", Value: "1"},
+		{Type: TxnSet, Key: "txn/b/y", Value: "2"},
+	}))
+	for key, want := range map[string]string{"txn/a/x": "1", "txn/b/y": "2"} {
+		if v, err := b.Get(key); err != nil || v != want {
+			t.Errorf("got Get(%q) == %q, %v, want %q", key, v, err, want)
+		}
+	}
+
+	// A failing op prevents the other ops from being applied.
+	err := b.Txn([]TxnOp{
+		{Type: TxnSet, Key: "txn/c", Value: "3"},
+		{Type: TxnCreate, Key: "txn/a/x", Value: "4"},
+	})
+	if err != ErrKeyExists {
+		t.Errorf("got Txn error %v, want ErrKeyExists", err)
+	}
+	if _, err := b.Get("txn/c"); err != ErrKeyNotExist {
+		t.Errorf("got Get error %v after failed Txn, want ErrKeyNotExist", err)
+	}
+	if err := b.Txn([]TxnOp{{Type: TxnDelete, Key: "txn/a/x"}, {Type: TxnDelete, Key: "txn/nokey"}}); err != ErrKeyNotExist {
+		t.Errorf("got Txn error %v, want ErrKeyNotExist", err)
+	}
+
+	_, index, err := b.GetIndex("txn/b/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Txn([]TxnOp{{Type: TxnDelete, Key: "txn/a/x"}, {Type: TxnCompareAndDelete, Key: "txn/b/y", PrevIndex: index - 1}}); err != ErrCompareFailed {
+		t.Errorf("got Txn error %v, want ErrCompareFailed", err)
+	}
+	must(t, b.Txn([]TxnOp{{Type: TxnDelete, Key: "txn/a/x"}, {Type: TxnCompareAndDelete, Key: "txn/b/y", PrevIndex: index}}))
+	keys, err := b.ListKeys("txn", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got keys %v after deleting all keys, want none", keys)
+	}
 }
@@ -0,0 +1,279 @@
+package datad
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheReloadInterval is how often clients created by NewCachingClient load
+// the whole registry again (in case their watch missed any changes, e.g.,
+// because the backend doesn't implement IndexBackend).
+var CacheReloadInterval = 5 * time.Minute
+
+// NewCachingClient returns a client that serves routing decisions (NodesForKey
+// and the nodes that KeyTransports send requests to) from an in-memory copy of
+// the registry. The registry is loaded once, and the copy is kept fresh by
+// watching the backend for registry changes made since it was loaded (if the
+// backend is an IndexBackend), so KeyTransports pick up the new nodes of
+// their keys without calling SyncWithRegistry. Call Close to
+// stop watching the backend when the client is no longer needed.
+//
+// The copy may briefly lag behind the registry (e.g., a node that was just
+// registered to a key may not be used until the change is seen).
+func NewCachingClient(b Backend) (*Client, error) {
+	c := NewClient(b)
+	c.cache = &registryCache{c: c, stop: make(chan struct{})}
+	if err := c.cache.start(); err != nil {
+		c.cache.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops keeping c's copy of the registry fresh, if c was created by
+// NewCachingClient (and it affects all copies of c made by WithContext).
+// Otherwise it does nothing.
+func (c *Client) Close() error {
+	if c.cache != nil {
+		c.cache.close()
+	}
+	return nil
+}
+
+// registryCache is a copy of the nodes registered to each key, kept fresh by
+// watching the registry.
+type registryCache struct {
+	c *Client
+
+	// mu synchronizes access to nodes (the nodes registered to each key,
+	// normalized with keyPathJoin), versions (the value of version when
+	// each key's nodes last changed), version (which is incremented on
+	// each change), and loadVersion (the value of version when the
+	// registry was last loaded).
+	mu          sync.Mutex
+	nodes       map[string][]string
+	versions    map[string]uint64
+	version     uint64
+	loadVersion uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// start loads the registry and starts watching it for changes.
+func (rc *registryCache) start() error {
+	waitIndex, err := rc.load()
+	if err != nil {
+		return err
+	}
+	go rc.watch(waitIndex)
+	go rc.reloadPeriodically()
+	return nil
+}
+
+func (rc *registryCache) close() {
+	rc.stopOnce.Do(func() { close(rc.stop) })
+}
+
+// load replaces the cached nodes with those in the registry, except for the
+// keys whose nodes the watcher changed while the registry was being read
+// (which keep the watched nodes). It returns the waitIndex from which to
+// watch for the changes made since the registry was read, or 0 if the
+// backend is not an IndexBackend.
+func (rc *registryCache) load() (waitIndex uint64, err error) {
+	if ib, ok := rc.c.backend.(IndexBackend); ok {
+		index, err := ib.Index()
+		if err != nil {
+			return 0, err
+		}
+		waitIndex = index + 1
+	}
+
+	rc.mu.Lock()
+	loadStart := rc.version
+	rc.mu.Unlock()
+
+	km, err := rc.c.registry.KeyMap()
+	if err != nil {
+		return 0, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.version++
+	loaded := make(map[string][]string, len(km))
+	versions := make(map[string]uint64, len(km))
+	for key, nodes := range km {
+		key = keyPathJoin(key)
+		sort.Strings(nodes)
+		loaded[key] = nodes
+		versions[key] = rc.version
+	}
+	for key, version := range rc.versions {
+		if version > loadStart {
+			// Changed by the watcher during the load, so it's at least as
+			// fresh as what was read.
+			loaded[key] = rc.nodes[key]
+			versions[key] = version
+		}
+	}
+	rc.nodes, rc.versions, rc.loadVersion = loaded, versions, rc.version
+	return waitIndex, nil
+}
+
+// reloadPeriodically loads the registry every CacheReloadInterval until the
+// cache is closed.
+func (rc *registryCache) reloadPeriodically() {
+	t := time.NewTicker(CacheReloadInterval)
+	for {
+		select {
+		case <-t.C:
+			if _, err := rc.load(); err != nil {
+				rc.c.logf("Failed to reload registry cache: %s. Will retry next reload interval.", err)
+			}
+		case <-rc.stop:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// get returns the nodes registered to key and the version of the cache when
+// they last changed (or when the registry was last loaded).
+func (rc *registryCache) get(key string) (nodes []string, version uint64) {
+	key = keyPathJoin(key)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	version = rc.versions[key]
+	if version < rc.loadVersion {
+		version = rc.loadVersion
+	}
+	return append([]string(nil), rc.nodes[key]...), version
+}
+
+// watch applies changes to the registry, starting at waitIndex, to the cache
+// until it is closed. If the watch fails, it is resumed from the last change
+// seen (or, if changes were missed, the registry is loaded again).
+func (rc *registryCache) watch(waitIndex uint64) {
+	watchKey := keyPathJoin(registryPrefix, keysPrefix)
+	for {
+		events := make(chan *WatchEvent, 10)
+		done := make(chan struct{})
+
+		// Receive watched changes.
+		go func() {
+			defer close(done)
+			for ev := range events {
+				waitIndex = ev.Index + 1
+				rc.apply(watchKey, ev)
+			}
+		}()
+
+		err := rc.c.backend.Watch(watchKey, waitIndex, true, events, rc.stop)
+		<-done
+
+		select {
+		case <-rc.stop:
+			return
+		default:
+		}
+
+		if err == ErrWatchIndexCleared {
+			// Changes were missed, so load the registry again.
+			var loadErr error
+			waitIndex, loadErr = rc.load()
+			if loadErr != nil {
+				rc.c.logf("Failed to reload registry cache: %s.", loadErr)
+			}
+		}
+		rc.c.logf("The registry cache watcher failed: %v. Resuming watch in 1s.", err)
+		select {
+		case <-time.After(time.Second):
+		case <-rc.stop:
+			return
+		}
+	}
+}
+
+// apply applies a change to the registry (beneath watchKey) to the cache.
+func (rc *registryCache) apply(watchKey string, ev *WatchEvent) {
+	var rel string
+	if ev.Key != watchKey {
+		rel = strings.TrimPrefix(ev.Key, watchKey+"/")
+		if rel == ev.Key {
+			return
+		}
+	}
+	deleted := ev.Action == WatchDelete || ev.Action == WatchExpire
+
+	if ev.Dir {
+		if !deleted {
+			return
+		}
+		if key := strings.TrimSuffix(rel, "/"+keyNodesSubdir); key != rel {
+			// A key's registrations were deleted (but not those of the
+			// keys beneath it).
+			rc.remove(key, false)
+		} else {
+			// A parent of keys was deleted, along with the registrations
+			// of all keys beneath it.
+			rc.remove(rel, true)
+		}
+		return
+	}
+
+	parts := strings.Split(rel, "/"+keyNodesSubdir+"/")
+	if len(parts) != 2 || strings.Contains(parts[1], "/") {
+		// Not a registration (e.g., a key's lock file).
+		return
+	}
+	key, node := keyPathJoin(parts[0]), parts[1]
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	nodes := rc.nodes[key]
+	switch {
+	case deleted && containsString(nodes, node):
+		nodes = removeString(append([]string(nil), nodes...), node)
+	case !deleted && !containsString(nodes, node):
+		nodes = append(append([]string(nil), nodes...), node)
+		sort.Strings(nodes)
+	default:
+		// Only the registration's status changed.
+		return
+	}
+	rc.version++
+	rc.nodes[key] = nodes
+	rc.versions[key] = rc.version
+}
+
+// remove removes the registrations of key, and of all keys beneath it if
+// recursive is true.
+func (rc *registryCache) remove(key string, recursive bool) {
+	key = keyPathJoin(key)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.version++
+	for k, nodes := range rc.nodes {
+		if (k == key || (recursive && strings.HasPrefix(k, trailingSlash(key)))) && len(nodes) > 0 {
+			rc.nodes[k] = nil
+			rc.versions[k] = rc.version
+		}
+	}
+}
+
+// syncWithCache updates t.nodes from the client's registry cache if key's
+// nodes have changed since t last synced with it. The caller must hold
+// t.nodesMu.
+func (t *KeyTransport) syncWithCache() {
+	if t.c.cache == nil {
+		return
+	}
+	if nodes, version := t.c.cache.get(t.key); version > t.cacheVersion {
+		t.nodes, t.cacheVersion = nodes, version
+	}
+}
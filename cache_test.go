@@ -0,0 +1,164 @@
+package datad
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitForNodes waits until c's NodesForKey(key) returns want.
+func waitForNodes(t *testing.T, c *Client, key string, want []string) {
+	var nodes []string
+	for i := 0; i < 100; i++ {
+		var err error
+		nodes, err = c.NodesForKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(nodes, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got NodesForKey(%q) == %v, want %v", key, nodes, want)
+}
+
+func TestCachingClient(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	must(t, r.Add("k", "n1:80"))
+	must(t, r.Add("d/k2", "n1:80"))
+
+	c, err := NewCachingClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The registry is loaded.
+	waitForNodes(t, c, "k", []string{"n1:80"})
+	waitForNodes(t, c, "/d/k2", []string{"n1:80"})
+
+	// Registry changes are applied.
+	must(t, r.Add("k", "n0:80"))
+	waitForNodes(t, c, "k", []string{"n0:80", "n1:80"})
+	must(t, r.Remove("k", "n1:80"))
+	waitForNodes(t, c, "k", []string{"n0:80"})
+	must(t, b.DeleteDir(keyPathJoin(registryPrefix, keysPrefix, "d")))
+	waitForNodes(t, c, "d/k2", nil)
+
+	// Status changes don't change the nodes.
+	must(t, r.SetStatus("k", "n0:80", RegistrationStatus{State: StateReady}))
+	waitForNodes(t, c, "k", []string{"n0:80"})
+
+	// After Close, registry changes aren't applied.
+	must(t, c.Close())
+	time.Sleep(50 * time.Millisecond)
+	must(t, r.Add("k", "n2:80"))
+	time.Sleep(50 * time.Millisecond)
+	if nodes, _ := c.NodesForKey("k"); !reflect.DeepEqual(nodes, []string{"n0:80"}) {
+		t.Errorf("got NodesForKey == %v after Close, want [n0:80]", nodes)
+	}
+}
+
+// Test that the KeyTransports of a caching client pick up changes to their
+// key's nodes without SyncWithRegistry.
+func TestCachingClient_KeyTransport(t *testing.T) {
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) })
+	}
+	ds1 := httptest.NewServer(handler("ds1"))
+	defer ds1.Close()
+	ds2 := httptest.NewServer(handler("ds2"))
+	defer ds2.Close()
+	node1, node2 := cleanNodeName(ds1.URL), cleanNodeName(ds2.URL)
+
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	must(t, r.add("k", node1, RegistrationStatus{State: StateReady}, ReasonAssigned))
+
+	c, err := NewCachingClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	transport, err := c.TransportForKey("k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := httpGet("before move", t, transport, "/k"); body != "ds1" {
+		t.Errorf("before move: got body %q, want %q", body, "ds1")
+	}
+
+	// Move the key to the other node.
+	must(t, r.add("k", node2, RegistrationStatus{State: StateReady}, ReasonAssigned))
+	must(t, r.Remove("k", node1))
+	waitForNodes(t, c, "k", []string{node2})
+	if body := httpGet("after move", t, transport, "/k"); body != "ds2" {
+		t.Errorf("after move: got body %q, want %q", body, "ds2")
+	}
+}
+
+// Test that changes made while a caching client loads the registry are not
+// lost, whether they are made before the watch starts or while the watch is
+// running.
+func TestCachingClient_ChangesDuringLoad(t *testing.T) {
+	b := &listHookBackend{MemoryBackend: NewMemoryBackend()}
+	r := NewRegistry(b.MemoryBackend)
+	must(t, r.Add("k", "n1:80"))
+
+	// Before the watch starts.
+	b.afterList = func() { must(t, r.Add("k", "n2:80")) }
+	c, err := NewCachingClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitForNodes(t, c, "k", []string{"n1:80", "n2:80"})
+
+	// While the watch is running (and the watched change is applied before
+	// the reload finishes).
+	b.afterList = func() {
+		must(t, r.Add("k", "n3:80"))
+		waitForNodes(t, c, "k", []string{"n1:80", "n2:80", "n3:80"})
+	}
+	if _, err := c.cache.load(); err != nil {
+		t.Fatal(err)
+	}
+	waitForNodes(t, c, "k", []string{"n1:80", "n2:80", "n3:80"})
+}
+
+// Test that deleting a key's registrations doesn't remove the cached nodes of
+// the keys beneath it.
+func TestCachingClient_NestedKeys(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	must(t, r.Add("a", "n1:80"))
+	must(t, r.Add("a/b", "n2:80"))
+
+	c, err := NewCachingClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	must(t, r.Remove("a", "n1:80"))
+	must(t, r.deleteIfUnregistered("a"))
+	// Changes are applied in order, so once this one is applied, so are
+	// those above.
+	must(t, r.Add("c", "n3:80"))
+	waitForNodes(t, c, "c", []string{"n3:80"})
+	if nodes, err := c.NodesForKey("a"); err != nil || len(nodes) != 0 {
+		t.Errorf("got NodesForKey(a) == %v, %v, want none", nodes, err)
+	}
+	if nodes, err := c.NodesForKey("a/b"); err != nil || !reflect.DeepEqual(nodes, []string{"n2:80"}) {
+		t.Errorf("got NodesForKey(a/b) == %v, %v, want [n2:80]", nodes, err)
+	}
+
+	// Deleting a parent of keys removes the keys beneath it.
+	must(t, b.DeleteDir(keyPathJoin(registryPrefix, keysPrefix, "a")))
+	waitForNodes(t, c, "a/b", nil)
+}
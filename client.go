@@ -2,6 +2,7 @@ package datad
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // A Client routes requests for data.
@@ -22,6 +24,44 @@ type Client struct {
 	// then KeyURLPrefix would be "/api/".
 	KeyURLPrefix string
 
+	// Replication determines the number of nodes that Update registers each
+	// key to.
+	Replication ReplicationPolicy
+
+	// Placement decides which nodes Update registers keys to. If nil,
+	// RendezvousPlacement is used.
+	Placement Placement
+
+	// FailureClassifier decides which failed requests made by KeyTransports
+	// mean that the node can't serve the key's data (so that the node is
+	// deregistered from the key). If nil, DefaultFailureClassifier is used.
+	FailureClassifier FailureClassifier
+
+	// Selector decides the order in which KeyTransports try the nodes that
+	// each key is registered to. If nil, OrderedSelector is used.
+	Selector Selector
+
+	// HedgeDelay, if nonzero, enables hedged requests: if a node hasn't
+	// responded to a KeyTransport's request after HedgeDelay, the request is
+	// also sent to the key's next node, and the first successful response
+	// is used (and the other requests are canceled). Only requests without
+	// bodies are hedged.
+	HedgeDelay time.Duration
+
+	// HedgePercentile, if nonzero (and at most 100), enables hedged requests
+	// with a delay of that percentile of the latencies of this client's
+	// recent successful requests. Until enough requests have been made,
+	// HedgeDelay is used.
+	HedgePercentile float64
+
+	// latencies holds the latencies of recent successful requests (for
+	// HedgePercentile).
+	latencies *latencyWindow
+
+	// cache, if set, is the copy of the registry that routing decisions are
+	// made from (see NewCachingClient).
+	cache *registryCache
+
 	backend Backend
 
 	registry *Registry
@@ -31,28 +71,48 @@ type Client struct {
 
 func NewClient(b Backend) *Client {
 	return &Client{
-		backend:  b,
-		registry: NewRegistry(b),
-		Log:      log.New(os.Stderr, "datad client: ", log.Ltime|log.Lmicroseconds|log.Lshortfile),
+		backend:   b,
+		registry:  NewRegistry(b),
+		latencies: &latencyWindow{},
+		Log:       log.New(os.Stderr, "datad client: ", log.Ltime|log.Lmicroseconds|log.Lshortfile),
 	}
 }
 
 var ErrNoNodesForKey = errors.New("key has no nodes")
 
+// ErrKeyNotReady is returned by KeyTransport.RoundTrip when none of the key's
+// nodes responded successfully but some of them are still fetching the key
+// for the first time. The request may succeed if it is retried later.
+var ErrKeyNotReady = errors.New("key is not ready yet (its nodes are still fetching it)")
+
 // NodesInCluster returns a list of all nodes in the cluster.
 func (c *Client) NodesInCluster() ([]string, error) {
 	return c.backend.List(nodesPrefix, false)
 }
 
+// isMember reports whether node is currently a member of the cluster (i.e.,
+// whether its membership has not expired).
+func (c *Client) isMember(node string) (bool, error) {
+	_, err := c.backend.Get(keyPathJoin(nodesPrefix, node))
+	if err == ErrKeyNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // NodesForKey returns a list of nodes that, according to the registry, hold the
 // data specified by key.
 func (c *Client) NodesForKey(key string) ([]string, error) {
+	if c.cache != nil {
+		nodes, _ := c.cache.get(key)
+		return nodes, nil
+	}
 	return c.registry.NodesForKey(key)
 }
 
 // Update updates key from the data source on the nodes that are registered to
-// it. If key is not registered to any nodes, a node is registered for it and
-// the key is created on that node.
+// it. If key is registered to fewer nodes than c.Replication requires, more
+// nodes are registered for it and the key is created on those nodes.
 func (c *Client) Update(key string) (nodes []string, err error) {
 	return c.update(key, nil, nil, nil)
 }
@@ -71,58 +131,103 @@ func (c *Client) update(key string, nodesForKey []string, clusterNodes []string,
 		}
 	}
 
-	if len(nodesForKey) == 0 {
-		// Register a node for the key.
-		if clusterNodes == nil {
-			clusterNodes, err = c.NodesInCluster()
-			if err != nil {
-				return nil, err
-			}
+	// The nodes that key is still registered to (not nil, so that register
+	// doesn't look them up again).
+	registered := make([]string, 0, len(nodesForKey))
+	for i, node := range nodesForKey {
+		c.logf("Triggering update of key %q on node %s (%d/%d)...", key, node, i+1, len(nodesForKey))
+		// Each node watches its list of registered keys, so just modifying
+		// the registration will trigger an update.
+		err = c.registry.RequestUpdate(key, node)
+		if err == ErrKeyNotExist {
+			// The key was concurrently deregistered from the node, so the
+			// node no longer counts toward the key's replicas.
+			continue
+		} else if err != nil && err != ErrCompareFailed {
+			// (ErrCompareFailed means that the key was concurrently
+			// updated on the node, which is fine.)
+			return nil, err
 		}
+		registered = append(registered, node)
+	}
+	if len(registered) > 0 {
+		c.logf("Finished triggering updates of key %q on %d nodes (%v).", key, len(registered), registered)
+	}
 
-		// Exclude nodes.
-		if len(excludeNodes) > 0 {
-			var clusterNodes2 []string
-			for _, cnode := range clusterNodes {
-				if _, exclude := excludeNodes[cnode]; !exclude {
-					clusterNodes2 = append(clusterNodes2, cnode)
-				}
-			}
-			clusterNodes = clusterNodes2
-		}
+	return c.register(key, registered, clusterNodes, excludeNodes)
+}
 
-		if len(clusterNodes) == 0 {
-			return nil, ErrNoAvailableNodesForRegistration
+// register registers key to more nodes if it is registered to fewer nodes
+// than c.Replication requires, and returns the nodes that key is registered
+// to. The nodesForKey, clusterNodes, and excludeNodes params are as for
+// update.
+func (c *Client) register(key string, nodesForKey []string, clusterNodes []string, excludeNodes map[string]struct{}) (nodes []string, err error) {
+	if nodesForKey == nil {
+		nodesForKey, err = c.NodesForKey(key)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// Try to choose the same node as other clients that might be calling Update on the same key concurrently.
-		regNode := clusterNodes[keyBucket(key, len(clusterNodes))]
-
-		c.logf("Key to update does not exist yet: %q; registering key to node %s (will trigger update).", key, regNode)
+	replicas, err := c.replicas(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodesForKey) >= replicas {
+		return nodesForKey, nil
+	}
 
-		// TODO(sqs): optimize this by only adding if not exists, and then
-		// seeing if it exists (to avoid potentially duplicating work).
-		err = c.registry.Add(key, regNode)
+	// Register more nodes for the key.
+	if clusterNodes == nil {
+		clusterNodes, err = c.NodesInCluster()
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		// The call to Add will trigger the update on the node, so we're done.
-		return []string{regNode}, nil
+	// Exclude nodes.
+	if len(excludeNodes) > 0 {
+		var clusterNodes2 []string
+		for _, cnode := range clusterNodes {
+			if _, exclude := excludeNodes[cnode]; !exclude {
+				clusterNodes2 = append(clusterNodes2, cnode)
+			}
+		}
+		clusterNodes = clusterNodes2
 	}
 
-	for i, node := range nodesForKey {
-		c.logf("Triggering update of key %q on node %s (%d/%d)...", key, node, i+1, len(nodesForKey))
-		// Each node watches its list of registered keys, so just re-adding it
-		// to the registry will trigger an update.
-		err = c.registry.Add(key, node)
-		if err != nil {
-			return nil, err
+	// Exclude nodes that are full (or that recently evicted key).
+	clusterNodes, err = c.acceptingNodesForKey(key, clusterNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clusterNodes) == 0 {
+		if len(nodesForKey) > 0 {
+			return nodesForKey, nil
 		}
+		return nil, ErrNoAvailableNodesForRegistration
 	}
-	c.logf("Finished triggering updates of key %q on %d nodes (%v).", key, len(nodesForKey), nodesForKey)
 
-	return nodesForKey, nil
+	// Try to choose the same nodes as other clients that might be calling
+	// Update on the same key concurrently.
+	candidates := c.placement().Nodes(key, clusterNodes)
+
+	c.logf("Key to update is registered to %d/%d nodes: %q; registering key to more nodes (will trigger update).", len(nodesForKey), replicas, key)
+
+	// If another client registered the key concurrently, this returns the
+	// nodes that it registered (and it triggered the update).
+	nodes, err = c.registry.AddReplicas(key, candidates, replicas)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) < replicas {
+		c.logf("Key %q is registered to only %d/%d nodes (%v), because there are not enough nodes in the cluster.", key, len(nodes), replicas, nodes)
+	}
+
+	// The registration will trigger the update on the new nodes, so we're
+	// done.
+	return nodes, nil
 }
 
 // TransportForKey returns a HTTP transport (http.RoundTripper) optimized for
@@ -153,7 +258,11 @@ type KeyTransport struct {
 	c         *Client
 	transport http.RoundTripper
 
-	// nodesMu synchronizes access to nodes.
+	// cacheVersion is the version of the client's registry cache (if any)
+	// that nodes were last synced with.
+	cacheVersion uint64
+
+	// nodesMu synchronizes access to nodes and cacheVersion.
 	nodesMu sync.Mutex
 }
 
@@ -177,10 +286,19 @@ func (e *KeyTransportError) Error() string {
 	return fmt.Sprintf("no nodes responded successfully for %q (node errors: %s) (other error: %v)", e.URL, strings.Join(summary, "; "), e.OtherError)
 }
 
-// RoundTrip implements http.RoundTripper. If at least one node responds
-// successfully, no error is returned. If all nodes fail to respond
-// successfully, a *KeyTransportError is returned with the errors from each
-// node.
+// RoundTrip implements http.RoundTripper. It tries the key's nodes in the
+// order chosen by the client's Selector. If at least one node responds
+// successfully, no error is returned. If a node's response (or error) is an
+// ApplicationFailure (according to the client's FailureClassifier), it is
+// returned as is. The registry operations that RoundTrip performs are bound
+// to req's context. Nodes whose requests fail with a NodeFailure are
+// deregistered from the key, unless they are still fetching it for the first
+// time. If all nodes fail to respond successfully, ErrKeyNotReady is
+// returned if any of them are still fetching the key; otherwise a
+// *KeyTransportError is returned with the errors from each node. If the
+// client hedges requests (see Client.HedgeDelay), a request may be sent to
+// several nodes at once; the first successful response is returned, and the
+// other requests are canceled.
 func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Clone the request so we can modify the URL.
 	req2 := *req
@@ -196,9 +314,15 @@ func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		req2.URL.Scheme = "http"
 	}
 
+	// Bind the registry operations to the request's context.
+	c := t.c.WithContext(req.Context())
+
 	t.nodesMu.Lock()
+	t.syncWithCache()
 	nodes := t.nodes
 	t.nodesMu.Unlock()
+	selector := t.c.selector()
+	nodes = selector.Select(t.key, nodes)
 
 	// Track failed nodes so we don't reregister this key to them.
 	failedNodes := make(map[string]struct{})
@@ -206,15 +330,126 @@ func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Track the errors we saw from each node's response.
 	nodeErrors := make(map[string]error)
 
-	for i, node := range nodes {
-		// TODO(sqs): this code assumes the node is a "host:port".
-		req2.URL.Host = node
+	// Track whether any nodes have not finished fetching the key.
+	var notReady bool
 
-		resp, err := t.transport.RoundTrip(&req2)
-		if err == nil && (resp.StatusCode >= 200 && resp.StatusCode <= 399) {
+	// Only requests without bodies can be sent to more than one node at a
+	// time (because bodies can only be read once).
+	var hedgeDelay time.Duration
+	if req.Body == nil || req.Body == http.NoBody {
+		hedgeDelay = t.c.hedgeDelay()
+	}
+
+	// Send the request to the nodes (in order). The request is sent to the
+	// next node when a node fails or, if hedging, when a node hasn't
+	// responded after hedgeDelay.
+	type nodeResult struct {
+		node    string
+		resp    *http.Response
+		err     error
+		latency time.Duration
+		cancel  context.CancelFunc
+	}
+	results := make(chan nodeResult, len(nodes))
+	cancels := make(map[string]context.CancelFunc, len(nodes))
+	started, pending := 0, 0
+	startNext := func() bool {
+		if started == len(nodes) {
+			return false
+		}
+		node := nodes[started]
+		started++
+		pending++
+
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[node] = cancel
+		nodeReq := req2.WithContext(ctx)
+		u := *req2.URL
+		u.Host = node // TODO(sqs): this code assumes the node is a "host:port".
+		nodeReq.URL = &u
+		go func() {
+			start := time.Now()
+			resp, err := t.transport.RoundTrip(nodeReq)
+			results <- nodeResult{node, resp, err, time.Since(start), cancel}
+		}()
+		return true
+	}
+	defer func() {
+		// Cancel the requests that are still pending, and close their
+		// responses' bodies.
+		for _, cancel := range cancels {
+			cancel()
+		}
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.resp != nil {
+					r.resp.Body.Close()
+				}
+			}
+		}(pending)
+	}()
+
+	var hedge *time.Timer
+	var hedgeC <-chan time.Time
+	if hedgeDelay > 0 {
+		hedge = time.NewTimer(hedgeDelay)
+		defer hedge.Stop()
+		hedgeC = hedge.C
+	}
+
+	startNext()
+	for pending > 0 {
+		var r nodeResult
+		select {
+		case r = <-results:
+			pending--
+		case <-hedgeC:
+			if startNext() {
+				t.c.logf("Transport for key %q: node didn't respond to request for %q within %s; also sending it to node %q.", t.key, req.URL, hedgeDelay, nodes[started-1])
+				hedge.Reset(hedgeDelay)
+			}
+			continue
+		}
+		node, resp, err := r.node, r.resp, r.err
+
+		failure := t.classify(req.URL.Path, resp, err)
+		if failure == NoFailure {
+			t.c.latencies.record(r.latency)
+			if o, ok := selector.(LatencyObserver); ok {
+				o.ObserveLatency(node, r.latency)
+			}
+			// Cancel the request's context only when the caller is done
+			// with the response.
+			delete(cancels, node)
+			resp.Body = cancelOnClose{resp.Body, r.cancel}
 			return resp, nil
 		}
 
+		if cerr := req.Context().Err(); cerr != nil {
+			// The request was canceled, so its failure says nothing about
+			// the node.
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, cerr
+		}
+
+		// Application failures are the caller's to handle. (They are
+		// returned without looking up the node's registration status, so
+		// that they don't cost a registry round trip.)
+		if failure == ApplicationFailure {
+			if resp != nil {
+				delete(cancels, node)
+				resp.Body = cancelOnClose{resp.Body, r.cancel}
+			}
+			return resp, err
+		}
+
+		// If the node is still fetching the key for the first time, it is
+		// expected to fail, so try the other nodes but don't deregister it.
+		status, serr := c.registry.Status(t.key, node)
+		busy := serr == nil && status.Busy()
+
 		if err == nil {
 			defer resp.Body.Close()
 			var body []byte
@@ -225,17 +460,39 @@ func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			err = &HTTPError{resp.StatusCode, string(bytes.TrimSpace(body))}
 		}
 
-		// Remove this node from the registry and from t.nodes.
-		t.c.logf("Transport for key %q: HTTP request for %q failed (%s); deregistering node %q from key.", t.key, req.URL, err, node)
-		if err := t.c.registry.Remove(t.key, node); err != nil && !isEtcdKeyNotExist(err) {
-			return nil, err
+		if busy {
+			t.c.logf("Transport for key %q: HTTP request for %q failed (%s), but node %q is still fetching the key (%s since %s).", t.key, req.URL, err, node, status.State, status.Time)
+			nodeErrors[node] = err
+			notReady = true
+		} else {
+			// Remove this node from the registry and from t.nodes.
+			t.c.logf("Transport for key %q: HTTP request for %q failed (%s); deregistering node %q from key.", t.key, req.URL, err, node)
+			if err := c.registry.Remove(t.key, node); err != nil && err != ErrKeyNotExist && err != ErrCompareFailed {
+				return nil, err
+			}
+			t.nodesMu.Lock()
+			t.nodes = removeString(append([]string{}, t.nodes...), node)
+			t.nodesMu.Unlock()
+
+			failedNodes[node] = struct{}{}
+			nodeErrors[node] = err
 		}
-		t.nodesMu.Lock()
-		t.nodes = append(t.nodes[:i], t.nodes[i:]...)
-		t.nodesMu.Unlock()
 
-		failedNodes[node] = struct{}{}
-		nodeErrors[node] = err
+		// Fall back to the next node (if no other requests are pending).
+		if pending == 0 && startNext() && hedge != nil {
+			if !hedge.Stop() {
+				select {
+				case <-hedge.C:
+				default:
+				}
+			}
+			hedge.Reset(hedgeDelay)
+		}
+	}
+
+	if notReady {
+		t.c.logf("Transport for key %q: No nodes responded successfully to request for %q, but some are still fetching the key.", t.key, req.URL)
+		return nil, ErrKeyNotReady
 	}
 
 	kte := &KeyTransportError{URL: req2.URL.String(), NodeErrors: nodeErrors}
@@ -248,7 +505,7 @@ func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	t.c.logf("Transport for key %q: No nodes' data sources responded successfully to request for %q. Registering key to a new node and triggering an update.", t.key, req.URL)
 
 	// Register this key with a new node and trigger an update.
-	regNodes, err := t.c.update(t.key, []string{}, nil, failedNodes)
+	regNodes, err := c.update(t.key, []string{}, nil, failedNodes)
 	if err != nil {
 		kte.OtherError = err
 		return nil, kte
@@ -263,6 +520,22 @@ func (t *KeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, kte
 }
 
+// classify classifies the outcome of a request for path (relative to the
+// key's URL prefix) that was sent to one of the key's nodes, using the
+// client's FailureClassifier. If the client uses DefaultFailureClassifier, a
+// 404 response for the key's root path is a NodeFailure (because it means
+// that the node doesn't have the key's data), unless the response's
+// FailureHeader says otherwise.
+func (t *KeyTransport) classify(path string, resp *http.Response, err error) Failure {
+	failure := t.c.failureClassifier().Classify(resp, err)
+	if failure == ApplicationFailure && t.c.FailureClassifier == nil && err == nil &&
+		resp.StatusCode == http.StatusNotFound && resp.Header.Get(FailureHeader) == "" &&
+		strings.TrimSuffix(path, "/") == strings.TrimSuffix(slash(t.key), "/") {
+		return NodeFailure
+	}
+	return failure
+}
+
 // CancelRequest is to allow a nonzero Timeout on the http.Client. TODO(sqs):
 // check this.
 func (t *KeyTransport) CancelRequest(req *http.Request) {
@@ -270,7 +543,9 @@ func (t *KeyTransport) CancelRequest(req *http.Request) {
 }
 
 // SyncWithRegistry updates the list of nodes that this transport attempts to
-// make HTTP requests to. The new nodes are looked up in the registry.
+// make HTTP requests to. The new nodes are looked up in the registry. (The
+// transports of clients created by NewCachingClient are synced automatically
+// when their key's nodes change.)
 func (t *KeyTransport) SyncWithRegistry() error {
 	nodes, err := t.c.NodesForKey(t.key)
 	if err != nil {
@@ -285,6 +560,13 @@ func (t *KeyTransport) SyncWithRegistry() error {
 	return nil
 }
 
+func (c *Client) placement() Placement {
+	if c.Placement != nil {
+		return c.Placement
+	}
+	return RendezvousPlacement{}
+}
+
 func (c *Client) logf(format string, a ...interface{}) {
 	if c.Log != nil {
 		c.Log.Printf(format, a...)
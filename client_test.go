@@ -2,6 +2,7 @@ package datad
 
 import (
 	"reflect"
+	"sort"
 	"testing"
 
 	etcd_client "github.com/coreos/go-etcd/etcd"
@@ -33,3 +34,78 @@ func TestClient_NodesInCluster(t *testing.T) {
 		}
 	})
 }
+
+func TestClient_Update_Replication(t *testing.T) {
+	b := NewMemoryBackend()
+	for _, node := range []string{"a:80", "b:80", "c:80"} {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	c := NewClient(b)
+	c.Replication = ReplicationPolicy{Default: 2, Prefixes: map[string]int{"big": 5}}
+
+	tests := map[string]int{"k": 2, "big/k": 3}
+	for key, want := range tests {
+		nodes, err := c.Update(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		regNodes, err := c.NodesForKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		distinct := make(map[string]bool)
+		for _, node := range regNodes {
+			distinct[node] = true
+		}
+		if len(nodes) != want || len(regNodes) != want || len(distinct) != want {
+			t.Errorf("%q: got Update == %v and registered nodes %v, want %d distinct nodes", key, nodes, regNodes, want)
+		}
+	}
+
+	// A key with too few replicas (e.g., after a node failed) gets more.
+	regNodes, err := c.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	must(t, c.registry.Remove("k", regNodes[0]))
+	if nodes, err := c.Update("k"); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 2 {
+		t.Errorf("got Update == %v after removing a replica, want 2 nodes", nodes)
+	}
+}
+
+// Test that Update registers the key to another node if it was concurrently
+// deregistered from one of the nodes it was registered to.
+func TestClient_Update_ConcurrentDeregistration(t *testing.T) {
+	b := NewMemoryBackend()
+	for _, node := range []string{"a:80", "b:80", "c:80"} {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	c := NewClient(b)
+	c.Replication.Default = 2
+
+	must(t, c.registry.Add("k", "a:80"))
+	must(t, c.registry.Add("k", "b:80"))
+	nodesForKey, err := c.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is deregistered from b:80 after its nodes were listed.
+	must(t, c.registry.Remove("k", "b:80"))
+
+	nodes, err := c.update("k", nodesForKey, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regNodes, err := c.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(nodes)
+	sort.Strings(regNodes)
+	if len(nodes) != 2 || !reflect.DeepEqual(nodes, regNodes) {
+		t.Errorf("got update == %v and registered nodes %v, want the same 2 nodes", nodes, regNodes)
+	}
+}
@@ -0,0 +1,232 @@
+package datad
+
+import (
+	"context"
+	"net/http"
+)
+
+// A ContextProvider is a Provider whose updates can be canceled. Nodes cancel
+// their provider's in-flight updates when they are stopped.
+type ContextProvider interface {
+	Provider
+
+	// UpdateContext is like Update, but it stops updating key and returns
+	// ctx.Err() if ctx is done before the update finishes.
+	UpdateContext(ctx context.Context, key string) error
+}
+
+// NewContextProvider returns p if it is a ContextProvider. Otherwise it
+// returns an adapter whose UpdateContext calls p.Update and returns
+// ctx.Err() as soon as ctx is done, without waiting for p.Update (which
+// can't be interrupted, so it keeps running in the background).
+func NewContextProvider(p Provider) ContextProvider {
+	if cp, ok := p.(ContextProvider); ok {
+		return cp
+	}
+	return contextProvider{p}
+}
+
+type contextProvider struct{ Provider }
+
+func (p contextProvider) UpdateContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Update(key) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A ContextBackend is a Backend whose operations can be bound to a context.
+// EtcdV3Backend implements it.
+type ContextBackend interface {
+	Backend
+
+	// WithContext returns a copy of the backend whose operations are
+	// canceled (and fail with ctx.Err()) when ctx is done.
+	WithContext(ctx context.Context) Backend
+}
+
+// BackendWithContext returns b bound to ctx. If b is a ContextBackend, it
+// returns b.WithContext(ctx). Otherwise it returns an adapter that fails
+// each operation with ctx.Err() if ctx is done before the operation starts
+// (operations in progress are not interrupted, except for Watch, which stops
+// when ctx is done). The adapter is a TxnBackend if b is.
+func BackendWithContext(ctx context.Context, b Backend) Backend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.WithContext(ctx)
+	}
+	cb := contextBackend{b, ctx}
+	if tb, ok := b.(TxnBackend); ok {
+		return contextTxnBackend{cb, tb}
+	}
+	return cb
+}
+
+type contextBackend struct {
+	b   Backend
+	ctx context.Context
+}
+
+func (c contextBackend) Get(key string) (string, error) {
+	if err := c.ctx.Err(); err != nil {
+		return "", err
+	}
+	return c.b.Get(key)
+}
+
+func (c contextBackend) GetIndex(key string) (string, uint64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	return c.b.GetIndex(key)
+}
+
+func (c contextBackend) List(key string, recursive bool) ([]string, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.b.List(key, recursive)
+}
+
+func (c contextBackend) ListKeys(key string, recursive bool) ([]string, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.b.ListKeys(key, recursive)
+}
+
+func (c contextBackend) Set(key, value string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.Set(key, value)
+}
+
+func (c contextBackend) SetDir(key string, ttl uint64) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.SetDir(key, ttl)
+}
+
+func (c contextBackend) UpdateDir(key string, ttl uint64) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.UpdateDir(key, ttl)
+}
+
+func (c contextBackend) Delete(key string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.Delete(key)
+}
+
+func (c contextBackend) DeleteDir(key string) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.DeleteDir(key)
+}
+
+func (c contextBackend) Create(key, value string, ttl uint64) (uint64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.b.Create(key, value, ttl)
+}
+
+func (c contextBackend) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (uint64, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.b.CompareAndSwap(key, value, ttl, prevIndex)
+}
+
+func (c contextBackend) CompareAndDelete(key string, prevIndex uint64) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.b.CompareAndDelete(key, prevIndex)
+}
+
+func (c contextBackend) Watch(key string, waitIndex uint64, recursive bool, events chan<- *WatchEvent, stop <-chan struct{}) error {
+	if err := c.ctx.Err(); err != nil {
+		close(events)
+		return err
+	}
+
+	// Stop the watch when either stop is closed or ctx is done.
+	stop2 := make(chan struct{})
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go func() {
+		select {
+		case <-stop:
+		case <-c.ctx.Done():
+		case <-watchDone:
+			return
+		}
+		close(stop2)
+	}()
+	err := c.b.Watch(key, waitIndex, recursive, events, stop2)
+	if err == nil {
+		select {
+		case <-stop:
+		default:
+			err = c.ctx.Err()
+		}
+	}
+	return err
+}
+
+type contextTxnBackend struct {
+	contextBackend
+	tb TxnBackend
+}
+
+func (c contextTxnBackend) Txn(ops []TxnOp) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	return c.tb.Txn(ops)
+}
+
+// WithContext returns a copy of r whose operations are bound to ctx (see
+// BackendWithContext).
+func (r *Registry) WithContext(ctx context.Context) *Registry {
+	return NewRegistry(BackendWithContext(ctx, r.backend))
+}
+
+// WithContext returns a copy of c whose operations (and those of the
+// KeyTransports that it creates) are bound to ctx (see BackendWithContext).
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.backend = BackendWithContext(ctx, c.backend)
+	c2.registry = NewRegistry(c2.backend)
+	return &c2
+}
+
+// UpdateContext is like Update, but it stops and returns ctx.Err() if ctx is
+// done before the update is triggered on all of key's nodes.
+func (c *Client) UpdateContext(ctx context.Context, key string) (nodes []string, err error) {
+	return c.WithContext(ctx).Update(key)
+}
+
+// TransportForKeyContext is like TransportForKey, but the lookup of key's
+// nodes is bound to ctx. (Each request made with the transport is bound to
+// its own context; see KeyTransport.RoundTrip.)
+func (c *Client) TransportForKeyContext(ctx context.Context, key string, underlying http.RoundTripper) (*KeyTransport, error) {
+	nodes, err := c.WithContext(ctx).NodesForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.transportForKey(key, underlying, nodes)
+}
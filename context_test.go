@@ -0,0 +1,114 @@
+package datad
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewContextProvider(t *testing.T) {
+	p := blockingProvider{data: data{}, unblock: make(chan error, 1)}
+	cp := NewContextProvider(p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- cp.UpdateContext(ctx, "k") }()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("got UpdateContext error %v, want context.Canceled", err)
+	}
+	p.unblock <- nil // let the abandoned Update (if it started) finish
+
+	if got := NewContextProvider(cancelableProvider{}); reflect.TypeOf(got) != reflect.TypeOf(cancelableProvider{}) {
+		t.Errorf("got NewContextProvider == %#v, want the ContextProvider itself", got)
+	}
+}
+
+func TestBackendWithContext(t *testing.T) {
+	b := NewMemoryBackend()
+	must(t, b.Set("k", "v"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cb := BackendWithContext(ctx, b)
+	if _, ok := cb.(TxnBackend); !ok {
+		t.Error("got a non-TxnBackend, want the adapter of a TxnBackend to be a TxnBackend")
+	}
+	if v, err := cb.Get("k"); err != nil || v != "v" {
+		t.Errorf("got Get == %q, %v, want %q", v, err, "v")
+	}
+
+	events := make(chan *WatchEvent)
+	errc := make(chan error)
+	go func() { errc <- cb.Watch("k", 0, false, events, nil) }()
+
+	cancel()
+	if _, err := cb.Get("k"); err != context.Canceled {
+		t.Errorf("got Get error %v after cancel, want context.Canceled", err)
+	}
+	if err := cb.(TxnBackend).Txn([]TxnOp{{Type: TxnSet, Key: "k"}}); err != context.Canceled {
+		t.Errorf("got Txn error %v after cancel, want context.Canceled", err)
+	}
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("got Watch error %v after cancel, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Watch did not stop after cancel")
+	}
+}
+
+func TestNode_StopCancelsUpdates(t *testing.T) {
+	b := NewMemoryBackend()
+	p := cancelableProvider{noopUpdateProvider{data{}}, make(chan string, 1), make(chan string, 1)}
+	n := NewNode("n:80", b, p)
+	must(t, n.Start())
+	time.Sleep(50 * time.Millisecond)
+
+	must(t, n.registry.Add("k", n.Name))
+	select {
+	case <-p.started:
+	case <-time.After(time.Second):
+		t.Fatal("update did not start")
+	}
+	n.Stop()
+	select {
+	case <-p.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("update was not canceled")
+	}
+
+	// The canceled update doesn't mark the key as failed.
+	time.Sleep(50 * time.Millisecond)
+	if status, err := n.registry.Status("k", n.Name); err != nil || status.State == StateFailed {
+		t.Errorf("got status %+v, %v after Stop, want not failed", status, err)
+	}
+}
+
+// Test that a canceled request doesn't cause KeyTransport to deregister the
+// key's nodes.
+func TestKeyTransport_Canceled(t *testing.T) {
+	c := NewClient(NewMemoryBackend())
+	must(t, c.registry.add("k", "n:80", RegistrationStatus{State: StateReady}, ReasonAssigned))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transport, err := c.TransportForKeyContext(ctx, "k", failingTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	req, err := http.NewRequest("GET", "/k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&http.Client{Transport: transport}).Do(req.WithContext(ctx))
+	if uerr, ok := err.(*url.Error); !ok || uerr.Err != context.Canceled {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if nodes, err := c.NodesForKey("k"); err != nil || !reflect.DeepEqual(nodes, []string{"n:80"}) {
+		t.Errorf("got NodesForKey == %v, %v, want the node to remain registered", nodes, err)
+	}
+}
@@ -53,6 +53,27 @@ func keyPathJoin(components ...string) string {
 	return "/" + strings.Join(c2, "/")
 }
 
+// containsString reports whether s is in ss.
+func containsString(ss []string, s string) bool {
+	for _, s2 := range ss {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns ss without any occurrences of s. It modifies ss.
+func removeString(ss []string, s string) []string {
+	out := ss[:0]
+	for _, s2 := range ss {
+		if s2 != s {
+			out = append(out, s2)
+		}
+	}
+	return out
+}
+
 // A KeyFunc maps path-space onto key-space.
 //
 // In other words, it returns the key (a string) of the data stored at path. The
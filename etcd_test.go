@@ -59,6 +59,8 @@ func TestEtcdBackend(t *testing.T) {
 	withEtcd(t, func(ec *etcd_client.Client) {
 		b := NewEtcdBackend("/p", ec)
 		testBackend(t, b)
+		testBackendWatch(t, b)
+		testBackendCompareAndSwap(t, b)
 	})
 }
 
@@ -0,0 +1,746 @@
+package datad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var errWatchClosed = errors.New("etcd watch channel closed unexpectedly")
+
+// An EtcdV3Backend is a Backend that stores keys in etcd using the v3 (gRPC)
+// API.
+//
+// The v3 keyspace is flat, so directories are represented by marker keys
+// ending in "/" (e.g., "/datad/nodes/n/"). Otherwise keys have the same
+// slash-separated layout as with EtcdBackend, so the registry under the key
+// prefix remains readable with "etcdctl get --prefix /datad/".
+//
+// Directory TTLs are implemented with leases. A directory with a TTL is
+// attached to its own lease, and keys and directories created beneath it are
+// attached to the same lease, so they expire together. UpdateDir keeps the
+// lease alive.
+type EtcdV3Backend struct {
+	keyPrefix string
+	etcd      *clientv3.Client
+
+	// ctx is the context of etcd requests (set by WithContext), or nil for
+	// context.Background().
+	ctx context.Context
+
+	// markers is the lease that revocation markers are attached to (see
+	// CompareAndDelete). It is shared by the copies made by WithContext.
+	markers *v3MarkerLease
+}
+
+// v3MarkerLease is a lease that is replaced when half of its TTL
+// (revocationMarkerTTL) has elapsed, so that markers attached to it last for
+// at least half of the TTL.
+type v3MarkerLease struct {
+	mu      sync.Mutex
+	id      clientv3.LeaseID
+	renewAt time.Time
+}
+
+// revocationMarkerTTL is the TTL (in seconds) of the lease that revocation
+// markers are attached to. Watchers that see a key's deletion later than
+// half of the TTL after its lease was revoked report it as a WatchExpire.
+const revocationMarkerTTL = 10 * 60
+
+func NewEtcdV3Backend(keyPrefix string, c *clientv3.Client) Backend {
+	keyPrefix = slash(strings.TrimSuffix(keyPrefix, "/"))
+	return &EtcdV3Backend{keyPrefix: keyPrefix, etcd: c, markers: &v3MarkerLease{}}
+}
+
+// WithContext implements ContextBackend. Requests made by the returned
+// backend are canceled when ctx is done.
+func (c *EtcdV3Backend) WithContext(ctx context.Context) Backend {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+func (c *EtcdV3Backend) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+func (c *EtcdV3Backend) Get(key string) (string, error) {
+	key = c.fullKey(key)
+	kvs, err := c.stat(key, dirKey(key))
+	if err != nil {
+		return "", err
+	}
+	if kvs[0] != nil {
+		return string(kvs[0].Value), nil
+	} else if kvs[1] != nil {
+		return "", nil
+	}
+	return "", ErrKeyNotExist
+}
+
+func (c *EtcdV3Backend) GetIndex(key string) (string, uint64, error) {
+	key = c.fullKey(key)
+	kvs, err := c.stat(key, dirKey(key))
+	if err != nil {
+		return "", 0, err
+	}
+	if kvs[0] != nil {
+		return string(kvs[0].Value), uint64(kvs[0].ModRevision), nil
+	} else if kvs[1] != nil {
+		return "", uint64(kvs[1].ModRevision), nil
+	}
+	return "", 0, ErrKeyNotExist
+}
+
+func (c *EtcdV3Backend) ListKeys(key string, recursive bool) ([]string, error) {
+	return c.listNames(key, recursive, true)
+}
+
+func (c *EtcdV3Backend) List(key string, recursive bool) ([]string, error) {
+	return c.listNames(key, recursive, false)
+}
+
+func (c *EtcdV3Backend) listNames(key string, recursive, keysOnly bool) ([]string, error) {
+	dir := dirKey(c.fullKey(key))
+	resp, err := c.etcd.Get(c.context(), dir, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	// Map each name beneath dir to whether it is a directory. Directories
+	// are usually denoted by markers, but also infer them from the names of
+	// keys beneath them.
+	isDir := make(map[string]bool)
+	for _, kv := range resp.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), dir)
+		if name == "" {
+			// This is the marker for dir itself.
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			isDir[name] = true
+		} else if _, seen := isDir[name]; !seen {
+			isDir[name] = false
+		}
+		for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+			isDir[name[:i]] = true
+		}
+	}
+
+	var names []string
+	for name, dir := range isDir {
+		if (recursive || !strings.Contains(name, "/")) && (!keysOnly || !dir) {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(byKeyPath(names))
+	return names, nil
+}
+
+func (c *EtcdV3Backend) Set(key, value string) error {
+	key = c.fullKey(key)
+	dirs, lease, self, err := c.prepare(key)
+	if err != nil {
+		return err
+	}
+	if self.dir != nil {
+		return errNotFile
+	}
+	ops := append(putDirs(dirs, lease), clientv3.OpPut(key, value, clientv3.WithLease(lease)))
+	_, err = c.etcd.Txn(c.context()).Then(ops...).Commit()
+	return err
+}
+
+func (c *EtcdV3Backend) SetDir(key string, ttl uint64) error {
+	key = c.fullKey(key)
+	dirs, lease, self, err := c.prepare(key)
+	if err != nil {
+		return err
+	}
+	if self.dir != nil || self.file != nil {
+		return ErrKeyExists
+	}
+	ops := putDirs(dirs, lease)
+
+	if ttl > 0 {
+		grant, err := c.etcd.Grant(c.context(), int64(ttl))
+		if err != nil {
+			return err
+		}
+		lease = grant.ID
+	}
+
+	ops = append(ops, clientv3.OpPut(dirKey(key), "", clientv3.WithLease(lease)))
+	resp, err := c.etcd.Txn(c.context()).
+		If(clientv3.Compare(clientv3.CreateRevision(dirKey(key)), "=", 0)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		if ttl > 0 {
+			c.etcd.Revoke(c.context(), lease)
+		}
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// UpdateDir renews the TTL of the directory at key. If the directory already
+// has a TTL, its lease is kept alive (etcd does not allow changing a lease's
+// TTL, so ttl is only used when the directory had no TTL before).
+func (c *EtcdV3Backend) UpdateDir(key string, ttl uint64) error {
+	key = c.fullKey(key)
+	kvs, err := c.stat(dirKey(key), key)
+	if err != nil {
+		return err
+	}
+	if kvs[0] == nil {
+		if kvs[1] != nil {
+			return errNotDir
+		}
+		return ErrKeyNotExist
+	}
+
+	oldLease := clientv3.LeaseID(kvs[0].Lease)
+	if oldLease != clientv3.NoLease && ttl > 0 {
+		_, err := c.etcd.KeepAliveOnce(c.context(), oldLease)
+		if err == rpctypes.ErrLeaseNotFound {
+			return ErrKeyNotExist
+		}
+		return err
+	}
+
+	// Move the directory (and everything beneath it that shares its lease)
+	// to a new lease, or to no lease if ttl is 0.
+	var newLease clientv3.LeaseID
+	if ttl > 0 {
+		grant, err := c.etcd.Grant(c.context(), int64(ttl))
+		if err != nil {
+			return err
+		}
+		newLease = grant.ID
+	}
+	resp, err := c.etcd.Get(c.context(), dirKey(key), clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	var ops []clientv3.Op
+	for _, kv := range resp.Kvs {
+		if clientv3.LeaseID(kv.Lease) == oldLease {
+			ops = append(ops, clientv3.OpPut(string(kv.Key), string(kv.Value), clientv3.WithLease(newLease)))
+		}
+	}
+	_, err = c.etcd.Txn(c.context()).Then(ops...).Commit()
+	return err
+}
+
+func (c *EtcdV3Backend) Delete(key string) error {
+	key = c.fullKey(key)
+	resp, err := c.etcd.Txn(c.context()).
+		If(clientv3.Compare(clientv3.CreateRevision(dirKey(key)), "=", 0)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errNotFile
+	}
+	if resp.Responses[0].GetResponseDeleteRange().Deleted == 0 {
+		return ErrKeyNotExist
+	}
+	return nil
+}
+
+func (c *EtcdV3Backend) DeleteDir(key string) error {
+	key = c.fullKey(key)
+	resp, err := c.etcd.Txn(c.context()).
+		If(clientv3.Compare(clientv3.CreateRevision(dirKey(key)), ">", 0)).
+		Then(clientv3.OpDelete(dirKey(key), clientv3.WithPrefix())).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		if resp.Responses[0].GetResponseRange().Count > 0 {
+			return errNotDir
+		}
+		return ErrKeyNotExist
+	}
+	return nil
+}
+
+func (c *EtcdV3Backend) Create(key, value string, ttl uint64) (uint64, error) {
+	key = c.fullKey(key)
+	dirs, lease, self, err := c.prepare(key)
+	if err != nil {
+		return 0, err
+	}
+	if self.dir != nil || self.file != nil {
+		return 0, ErrKeyExists
+	}
+	ops := putDirs(dirs, lease)
+
+	if ttl > 0 {
+		grant, err := c.etcd.Grant(c.context(), int64(ttl))
+		if err != nil {
+			return 0, err
+		}
+		lease = grant.ID
+	}
+
+	ops = append(ops, clientv3.OpPut(key, value, clientv3.WithLease(lease)))
+	resp, err := c.etcd.Txn(c.context()).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(dirKey(key)), "=", 0),
+		).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		if ttl > 0 {
+			c.etcd.Revoke(c.context(), lease)
+		}
+		return 0, ErrKeyExists
+	}
+	return uint64(resp.Header.Revision), nil
+}
+
+// CompareAndSwap sets the value of key (attaching it to a new lease if ttl is
+// nonzero). If the swapped value had its own lease (because it was created or
+// swapped with a TTL), that lease is revoked, so that repeatedly renewing a
+// key's TTL does not accumulate leases.
+func (c *EtcdV3Backend) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (uint64, error) {
+	key = c.fullKey(key)
+	_, lease, self, err := c.prepare(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// The key's own lease, if it has one (rather than its parent's). It is
+	// only revoked if the swap replaces the value that was read here.
+	var oldLease clientv3.LeaseID
+	if self.file != nil && self.file.ModRevision == int64(prevIndex) && self.file.Lease != 0 && clientv3.LeaseID(self.file.Lease) != lease {
+		oldLease = clientv3.LeaseID(self.file.Lease)
+	}
+
+	if ttl > 0 {
+		grant, err := c.etcd.Grant(c.context(), int64(ttl))
+		if err != nil {
+			return 0, err
+		}
+		lease = grant.ID
+	}
+
+	resp, err := c.etcd.Txn(c.context()).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		if ttl > 0 {
+			c.etcd.Revoke(c.context(), lease)
+		}
+		return 0, v3CompareError(resp)
+	}
+	if oldLease != clientv3.NoLease {
+		// Nothing else is attached to it, so it's OK if this fails (it
+		// will expire anyway).
+		c.etcd.Revoke(c.context(), oldLease)
+	}
+	return uint64(resp.Header.Revision), nil
+}
+
+// CompareAndDelete deletes key only if its modification index is prevIndex.
+// If key had its own lease (because it was created or swapped with a TTL),
+// the lease is revoked, so that it doesn't linger until it expires. The
+// revocation is recorded (along with the deletion) so that watchers report
+// the deletion as a WatchDelete, not a WatchExpire.
+func (c *EtcdV3Backend) CompareAndDelete(key string, prevIndex uint64) error {
+	key = c.fullKey(key)
+	_, lease, self, err := c.prepare(key)
+	if err != nil {
+		return err
+	}
+
+	var oldLease clientv3.LeaseID
+	if f := self.file; f != nil && f.ModRevision == int64(prevIndex) && f.Lease != 0 && clientv3.LeaseID(f.Lease) != lease {
+		oldLease = clientv3.LeaseID(f.Lease)
+	}
+
+	var resp *clientv3.TxnResponse
+	for attempt := 0; ; attempt++ {
+		ops := []clientv3.Op{clientv3.OpDelete(key)}
+		if oldLease != clientv3.NoLease {
+			marker, err := c.markerLease()
+			if err != nil {
+				return err
+			}
+			ops = append(ops, clientv3.OpPut(c.revokedKey(oldLease), "", clientv3.WithLease(marker)))
+		}
+		resp, err = c.etcd.Txn(c.context()).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))).
+			Then(ops...).
+			Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+			Commit()
+		if err == rpctypes.ErrLeaseNotFound && oldLease != clientv3.NoLease && attempt == 0 {
+			// The marker lease expired early (e.g., because etcd's clock
+			// jumped), so grant a new one and try again.
+			c.markers.mu.Lock()
+			c.markers.id = clientv3.NoLease
+			c.markers.mu.Unlock()
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return v3CompareError(resp)
+	}
+	if oldLease != clientv3.NoLease {
+		// Nothing else is attached to it, so it's OK if this fails (it
+		// will expire anyway).
+		c.etcd.Revoke(c.context(), oldLease)
+	}
+	return nil
+}
+
+// markerLease returns the lease to attach revocation markers to, granting a
+// new one if half of the current one's TTL has elapsed.
+func (c *EtcdV3Backend) markerLease() (clientv3.LeaseID, error) {
+	m := c.markers
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.id != clientv3.NoLease && time.Now().Before(m.renewAt) {
+		return m.id, nil
+	}
+	grant, err := c.etcd.Grant(c.context(), revocationMarkerTTL)
+	if err != nil {
+		return 0, err
+	}
+	m.id, m.renewAt = grant.ID, time.Now().Add(revocationMarkerTTL*time.Second/2)
+	return m.id, nil
+}
+
+// revokedKey returns the key of the marker recording that this backend
+// revoked lease. It is outside of the key prefix, so it isn't listed or
+// watched.
+func (c *EtcdV3Backend) revokedKey(lease clientv3.LeaseID) string {
+	return fmt.Sprintf("/$$revoked%s/%x", strings.TrimSuffix(c.keyPrefix, "/"), int64(lease))
+}
+
+// v3CompareError returns the error for a failed compare-and-swap or
+// compare-and-delete transaction, whose else branch counts the keys that
+// exist at the compared key.
+func v3CompareError(resp *clientv3.TxnResponse) error {
+	if resp.Responses[0].GetResponseRange().Count == 0 {
+		return ErrKeyNotExist
+	}
+	return ErrCompareFailed
+}
+
+// Txn implements TxnBackend using a single etcd transaction, whose
+// conditions check that each op's key is in the expected state (and that no
+// missing parent directory was concurrently created as a file). If the
+// transaction fails, the ops are checked again to determine which one failed.
+//
+// etcd limits the number of operations in a transaction (128 by default), so
+// callers should keep transactions small.
+func (c *EtcdV3Backend) Txn(ops []TxnOp) error {
+	var cmps []clientv3.Cmp
+	var puts, dels []clientv3.Op
+	creating := make(map[string]bool)
+	for _, op := range ops {
+		key := c.fullKey(op.Key)
+		switch op.Type {
+		case TxnCreate, TxnSet:
+			dirs, lease, self, err := c.prepare(key)
+			if err != nil {
+				return err
+			}
+			if op.Type == TxnCreate && (self.file != nil || self.dir != nil) {
+				return ErrKeyExists
+			}
+			if self.dir != nil {
+				return errNotFile
+			}
+			for _, d := range dirs {
+				// Parents shared by several ops need only be created once
+				// (etcd rejects transactions that put the same key twice).
+				if !creating[d] {
+					creating[d] = true
+					puts = append(puts, clientv3.OpPut(d, "", clientv3.WithLease(lease)))
+				}
+				cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(strings.TrimSuffix(d, "/")), "=", 0))
+			}
+			if op.Type == TxnCreate {
+				cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+			}
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(dirKey(key)), "=", 0))
+			puts = append(puts, clientv3.OpPut(key, op.Value, clientv3.WithLease(lease)))
+		case TxnDelete:
+			cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), ">", 0))
+			dels = append(dels, clientv3.OpDelete(key))
+		case TxnCompareAndDelete:
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(op.PrevIndex)))
+			dels = append(dels, clientv3.OpDelete(key))
+		default:
+			return fmt.Errorf("unknown transaction op type %d", op.Type)
+		}
+	}
+
+	resp, err := c.etcd.Txn(c.context()).If(cmps...).Then(append(puts, dels...)...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return c.txnError(ops)
+	}
+	return nil
+}
+
+// txnError returns the error of the first op in a failed transaction whose
+// condition does not hold.
+func (c *EtcdV3Backend) txnError(ops []TxnOp) error {
+	for _, op := range ops {
+		key := c.fullKey(op.Key)
+		switch op.Type {
+		case TxnCreate, TxnSet:
+			_, _, self, err := c.prepare(key)
+			if err != nil {
+				return err
+			}
+			if op.Type == TxnCreate && (self.file != nil || self.dir != nil) {
+				return ErrKeyExists
+			}
+			if self.dir != nil {
+				return errNotFile
+			}
+		case TxnDelete, TxnCompareAndDelete:
+			kvs, err := c.stat(key, dirKey(key))
+			if err != nil {
+				return err
+			}
+			if kvs[0] == nil {
+				if kvs[1] != nil {
+					return errNotFile
+				}
+				return ErrKeyNotExist
+			}
+			if op.Type == TxnCompareAndDelete && uint64(kvs[0].ModRevision) != op.PrevIndex {
+				return ErrCompareFailed
+			}
+		}
+	}
+	// The conflicting change was undone before the ops were checked again.
+	return ErrCompareFailed
+}
+
+// Watch implements Backend. Deletions of keys whose lease has expired are
+// reported as WatchExpire events (but not those of keys whose lease was
+// revoked by CompareAndDelete).
+func (c *EtcdV3Backend) Watch(key string, waitIndex uint64, recursive bool, events chan<- *WatchEvent, stop <-chan struct{}) error {
+	defer close(events)
+
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(c.context()))
+	defer cancel()
+
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+	if waitIndex != 0 {
+		opts = append(opts, clientv3.WithRev(int64(waitIndex)))
+	}
+	wch := c.etcd.Watch(ctx, c.fullKey(key), opts...)
+
+	key = keyPathJoin(key)
+	for {
+		select {
+		case wr, ok := <-wch:
+			if !ok {
+				return errWatchClosed
+			}
+			if wr.CompactRevision != 0 {
+				return ErrWatchIndexCleared
+			}
+			if err := wr.Err(); err != nil {
+				if err == rpctypes.ErrCompacted {
+					return ErrWatchIndexCleared
+				}
+				return err
+			}
+			for _, e := range wr.Events {
+				ev := c.watchEvent(ctx, e)
+				if !watchMatches(key, ev.Key, recursive) {
+					continue
+				}
+				select {
+				case events <- ev:
+				case <-stop:
+					return nil
+				}
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (c *EtcdV3Backend) watchEvent(ctx context.Context, e *clientv3.Event) *WatchEvent {
+	k := strings.TrimPrefix(string(e.Kv.Key), trailingSlash(c.keyPrefix))
+	ev := &WatchEvent{
+		Key:   keyPathJoin(k),
+		Dir:   strings.HasSuffix(k, "/"),
+		Index: uint64(e.Kv.ModRevision),
+	}
+	switch {
+	case e.Type == mvccpb.DELETE:
+		ev.Action = WatchDelete
+		if e.PrevKv != nil && e.PrevKv.Lease != 0 {
+			lease := clientv3.LeaseID(e.PrevKv.Lease)
+			ttl, err := c.etcd.TimeToLive(ctx, lease)
+			if err == rpctypes.ErrLeaseNotFound || (err == nil && ttl.TTL == -1) {
+				ev.Action = WatchExpire
+				// Unless the lease was revoked after the key was deleted.
+				if resp, err := c.etcd.Get(ctx, c.revokedKey(lease), clientv3.WithCountOnly()); err == nil && resp.Count > 0 {
+					ev.Action = WatchDelete
+				}
+			}
+		}
+	case ev.Dir && e.IsModify():
+		ev.Action = WatchUpdate
+	default:
+		ev.Action = WatchSet
+		ev.Value = string(e.Kv.Value)
+	}
+	return ev
+}
+
+// v3Entry holds the file and directory marker (if any) stored at a key.
+type v3Entry struct{ file, dir *mvccpb.KeyValue }
+
+// prepare checks that none of key's parents are files, and it returns the
+// markers of any missing parent directories (which putDirs creates) along
+// with the lease that key should be attached to (that of its nearest parent
+// with a TTL). It also returns what is currently stored at key.
+func (c *EtcdV3Backend) prepare(key string) (dirs []string, lease clientv3.LeaseID, self v3Entry, err error) {
+	parents := c.parents(key)
+
+	lookup := make([]string, 0, 2*len(parents)+2)
+	for _, p := range parents {
+		lookup = append(lookup, p, dirKey(p))
+	}
+	lookup = append(lookup, key, dirKey(key))
+
+	kvs, err := c.stat(lookup...)
+	if err != nil {
+		return nil, 0, v3Entry{}, err
+	}
+
+	for i, p := range parents {
+		file, dir := kvs[2*i], kvs[2*i+1]
+		if file != nil {
+			return nil, 0, v3Entry{}, errNotDir
+		}
+		if dir == nil {
+			dirs = append(dirs, dirKey(p))
+		} else if dir.Lease != 0 {
+			lease = clientv3.LeaseID(dir.Lease)
+		}
+	}
+	self = v3Entry{file: kvs[len(kvs)-2], dir: kvs[len(kvs)-1]}
+	return dirs, lease, self, nil
+}
+
+// putDirs returns the operations that create the directory markers dirs,
+// attached to lease.
+func putDirs(dirs []string, lease clientv3.LeaseID) []clientv3.Op {
+	ops := make([]clientv3.Op, len(dirs))
+	for i, d := range dirs {
+		ops[i] = clientv3.OpPut(d, "", clientv3.WithLease(lease))
+	}
+	return ops
+}
+
+// stat returns the key-value pair stored at each key (or nil if there is
+// none), read in a single transaction.
+func (c *EtcdV3Backend) stat(keys ...string) ([]*mvccpb.KeyValue, error) {
+	ops := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		ops[i] = clientv3.OpGet(key)
+	}
+	resp, err := c.etcd.Txn(c.context()).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]*mvccpb.KeyValue, len(keys))
+	for i, r := range resp.Responses {
+		if rkvs := r.GetResponseRange().Kvs; len(rkvs) > 0 {
+			kvs[i] = rkvs[0]
+		}
+	}
+	return kvs, nil
+}
+
+// parents returns the full keys of key's parent directories beneath the key
+// prefix, outermost first.
+func (c *EtcdV3Backend) parents(key string) []string {
+	names := splitKey(strings.TrimPrefix(key, trailingSlash(c.keyPrefix)))
+	var parents []string
+	for i := 1; i < len(names); i++ {
+		parents = append(parents, keyPathJoin(c.keyPrefix, strings.Join(names[:i], "/")))
+	}
+	return parents
+}
+
+func (c *EtcdV3Backend) Index() (uint64, error) {
+	resp, err := c.etcd.Get(c.context(), dirKey(c.keyPrefix), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return uint64(resp.Header.Revision), nil
+}
+
+func (c *EtcdV3Backend) fullKey(keyWithoutPrefix string) string {
+	return keyPathJoin(c.keyPrefix, keyWithoutPrefix)
+}
+
+// dirKey returns the key of the marker for the directory at key.
+func dirKey(key string) string { return trailingSlash(key) }
+
+// byKeyPath sorts slash-separated key paths component by component, so that
+// each directory is immediately followed by its contents.
+type byKeyPath []string
+
+func (v byKeyPath) Len() int      { return len(v) }
+func (v byKeyPath) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byKeyPath) Less(i, j int) bool {
+	a, b := strings.Split(v[i], "/"), strings.Split(v[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
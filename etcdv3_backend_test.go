@@ -0,0 +1,173 @@
+package datad
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func withEtcdV3(t *testing.T, f func(*clientv3.Client)) {
+	cfg := embed.NewConfig()
+
+	cfg.Name = fmt.Sprintf("TEST%d", testNum)
+	clientURL := url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", 4401+testNum)}
+	peerURL := url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", 7701+testNum)}
+	testNum++
+
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	cfg.LogLevel = "error"
+
+	tmpdir, err := ioutil.TempDir("", "datad-etcdv3-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	cfg.Dir = tmpdir
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	<-e.Server.ReadyNotify()
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{clientURL.String()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Run f.
+	f(c)
+}
+
+func TestEtcdV3Backend(t *testing.T) {
+	withEtcdV3(t, func(c *clientv3.Client) {
+		b := NewEtcdV3Backend("/p", c)
+		testBackend(t, b)
+		testBackendWatch(t, b)
+		testBackendCompareAndSwap(t, b)
+		testBackendTxn(t, b.(TxnBackend))
+	})
+}
+
+func TestEtcdV3Backend_DirTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires at least 2s sleep")
+	}
+
+	withEtcdV3(t, func(c *clientv3.Client) {
+		// etcd rounds lease TTLs up to a minimum based on its election timeout.
+		testBackendDirTTL(t, NewEtcdV3Backend("/p", c), 2)
+	})
+}
+
+func TestEtcdV3Backend_Registry(t *testing.T) {
+	withEtcdV3(t, func(c *clientv3.Client) {
+		testRegistry(t, NewRegistry(NewEtcdV3Backend(DefaultKeyPrefix, c)))
+	})
+}
+
+// Test that swapping a key with a TTL doesn't leave the leases of its
+// previous values behind.
+func TestEtcdV3Backend_CompareAndSwapLeases(t *testing.T) {
+	withEtcdV3(t, func(c *clientv3.Client) {
+		b := NewEtcdV3Backend("/p", c)
+		leases := func() int {
+			resp, err := c.Leases(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(resp.Leases)
+		}
+
+		index, err := b.Create("/k", "v0", 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 3; i++ {
+			if index, err = b.CompareAndSwap("/k", fmt.Sprintf("v%d", i), 60, index); err != nil {
+				t.Fatal(err)
+			}
+			if n := leases(); n != 1 {
+				t.Errorf("after swap %d: got %d leases, want 1", i, n)
+			}
+		}
+
+		// A failed swap revokes neither lease.
+		if _, err := b.CompareAndSwap("/k", "x", 60, index-1); err != ErrCompareFailed {
+			t.Errorf("got CompareAndSwap error %v, want ErrCompareFailed", err)
+		}
+		if n := leases(); n != 1 {
+			t.Errorf("after failed swap: got %d leases, want 1", n)
+		}
+
+		// Swapping without a TTL leaves no lease.
+		if _, err := b.CompareAndSwap("/k", "v4", 0, index); err != nil {
+			t.Fatal(err)
+		}
+		if n := leases(); n != 0 {
+			t.Errorf("after swap without TTL: got %d leases, want 0", n)
+		}
+		if v, err := b.Get("/k"); err != nil || v != "v4" {
+			t.Errorf("got Get == %q, %v, want v4", v, err)
+		}
+	})
+}
+
+// Test that deleting a key with a TTL revokes its lease, and that watchers
+// report the deletion as a WatchDelete (not a WatchExpire).
+func TestEtcdV3Backend_CompareAndDeleteLeases(t *testing.T) {
+	withEtcdV3(t, func(c *clientv3.Client) {
+		b := NewEtcdV3Backend("/p", c)
+		leases := func() map[clientv3.LeaseID]bool {
+			resp, err := c.Leases(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := map[clientv3.LeaseID]bool{}
+			for _, l := range resp.Leases {
+				ids[l.ID] = true
+			}
+			return ids
+		}
+
+		index, err := b.Create("/d/k", "v", 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := leases()
+
+		events := make(chan *WatchEvent, 10)
+		stop := make(chan struct{})
+		defer close(stop)
+		go b.Watch("/d", index+1, true, events, stop)
+
+		must(t, b.CompareAndDelete("/d/k", index))
+		for id := range leases() {
+			if before[id] {
+				t.Errorf("lease %x of deleted key was not revoked", id)
+			}
+		}
+
+		select {
+		case ev := <-events:
+			if ev.Key != "/d/k" || ev.Action != WatchDelete {
+				t.Errorf("got watch event %+v, want a WatchDelete of /d/k", ev)
+			}
+		case <-time.After(time.Second):
+			t.Error("timed out waiting for watch event")
+		}
+	})
+}
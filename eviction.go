@@ -0,0 +1,296 @@
+package datad
+
+import (
+	"sort"
+	"time"
+)
+
+var (
+	// DefaultEvictionGracePeriod is the default value of
+	// Node.EvictionGracePeriod.
+	DefaultEvictionGracePeriod = 10 * time.Minute
+
+	// DefaultEvictionCooldown is the default value of
+	// Node.EvictionCooldown.
+	DefaultEvictionCooldown = 30 * time.Minute
+
+	// EvictionInterval is how often each node checks whether its data
+	// exceeds Node.MaxBytes (and evicts keys if so).
+	EvictionInterval = time.Minute
+)
+
+// scheduleEviction schedules the removal of this node's data for key (which
+// was deregistered from this node) after n.EvictionGracePeriod. It does
+// nothing if the provider does not implement KeyRemover.
+func (n *Node) scheduleEviction(key string) {
+	if _, ok := n.Provider.(KeyRemover); !ok {
+		return
+	}
+
+	grace := n.EvictionGracePeriod
+	if grace == 0 {
+		grace = DefaultEvictionGracePeriod
+	}
+
+	n.evictionsMu.Lock()
+	defer n.evictionsMu.Unlock()
+	if n.evictions == nil {
+		n.evictions = map[string]*time.Timer{}
+	}
+	if t, ok := n.evictions[key]; ok {
+		t.Stop()
+	}
+	n.logf("Key %q was deregistered from this node; removing its data in %s unless it is registered again.", key, grace)
+	var t *time.Timer
+	t = time.AfterFunc(grace, func() {
+		n.evictionsMu.Lock()
+		if n.evictions[key] != t {
+			// Canceled or rescheduled.
+			n.evictionsMu.Unlock()
+			return
+		}
+		delete(n.evictions, key)
+		n.evictionsMu.Unlock()
+
+		if err := n.evict(key); err != nil {
+			n.logf("Failed to remove data for deregistered key %q: %s.", key, err)
+		}
+	})
+	n.evictions[key] = t
+}
+
+// cancelEviction cancels the scheduled removal of this node's data for key
+// (because it was registered to this node again), if any.
+func (n *Node) cancelEviction(key string) {
+	n.evictionsMu.Lock()
+	defer n.evictionsMu.Unlock()
+	if t, ok := n.evictions[key]; ok {
+		t.Stop()
+		delete(n.evictions, key)
+	}
+}
+
+// evict removes this node's data for key, unless key is registered to this
+// node or this node is stopped.
+func (n *Node) evict(key string) error {
+	select {
+	case <-n.stopChan:
+		return nil
+	default:
+	}
+
+	if _, err := n.backend.Get(registrationSides(key, n.Name)[1]); err == nil {
+		// Registered again (and the watcher hasn't seen it yet).
+		return nil
+	} else if err != ErrKeyNotExist {
+		return err
+	}
+
+	n.logf("Removing data for deregistered key %q.", key)
+	err := n.Provider.(KeyRemover).Remove(key)
+	if err == ErrKeyNotExist {
+		return nil
+	}
+	return err
+}
+
+// RecordAccess records that this node's data for key was accessed, for use
+// in choosing which keys to evict when the node's data exceeds n.MaxBytes.
+// The server that serves the node's data should call it for each request.
+func (n *Node) RecordAccess(key string) {
+	n.accessMu.Lock()
+	defer n.accessMu.Unlock()
+	if n.accessed == nil {
+		n.accessed = map[string]time.Time{}
+	}
+	n.accessed[unslash(key)] = time.Now()
+}
+
+// lastAccess returns when this node's data for key was last accessed,
+// according to RecordAccess and to stat.
+func (n *Node) lastAccess(key string, stat *KeyStat) time.Time {
+	n.accessMu.Lock()
+	defer n.accessMu.Unlock()
+	if t := n.accessed[unslash(key)]; t.After(stat.Accessed) {
+		return t
+	}
+	return stat.Accessed
+}
+
+// evictPeriodically evicts keys every EvictionInterval (if needed) until this
+// node is stopped.
+func (n *Node) evictPeriodically() {
+	t := time.NewTicker(EvictionInterval)
+	for {
+		select {
+		case <-t.C:
+			if _, err := n.evictLRU(); err != nil {
+				n.logf("Error evicting keys: %s. Will retry next eviction interval.", err)
+			}
+		case <-n.stopChan:
+			t.Stop()
+			return
+		}
+	}
+}
+
+type keyUsage struct {
+	key      string
+	size     uint64
+	accessed time.Time
+}
+
+// evictLRU evicts the least recently used keys registered to this node until
+// its data fits in n.MaxBytes, and returns the number of keys it evicted.
+// Each key is deregistered from this node before its data is removed, so
+// that clients are not routed to this node for it. Pinned keys are not
+// evicted, nor are keys if that would leave fewer than
+// n.Replication.Minimum nodes with their data. Keys that no other node has
+// are removed from the registry.
+func (n *Node) evictLRU() (int, error) {
+	stater, ok := n.Provider.(KeyStater)
+	if !ok || n.MaxBytes == 0 {
+		return 0, nil
+	}
+	remover, ok := n.Provider.(KeyRemover)
+	if !ok {
+		return 0, nil
+	}
+
+	keys, err := n.registry.KeysForNode(n.Name)
+	if err != nil {
+		return 0, err
+	}
+	var usages []keyUsage
+	var total uint64
+	for _, key := range keys {
+		stat, err := stater.Stat(key)
+		if err == ErrKeyNotExist {
+			// Not fetched yet.
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		usages = append(usages, keyUsage{key: key, size: stat.Size, accessed: n.lastAccess(key, stat)})
+		total += stat.Size
+	}
+	if total <= n.MaxBytes {
+		n.setOverMaxBytes(false, false)
+		return 0, nil
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].accessed.Before(usages[j].accessed) })
+
+	n.logf("Data size (%d bytes) exceeds the maximum (%d bytes); evicting least recently used keys.", total, n.MaxBytes)
+	evicted := 0
+	for _, u := range usages {
+		if total <= n.MaxBytes {
+			break
+		}
+
+		if ok, err := n.canEvict(u.key); err != nil {
+			return evicted, err
+		} else if !ok {
+			continue
+		}
+
+		// Deregister the key first, so that clients are not routed to this
+		// node for it after its data is removed.
+		if err := n.registry.Remove(u.key, n.Name); err == ErrCompareFailed {
+			// Its registration is changing (e.g., it's being updated), so
+			// leave it for now.
+			continue
+		} else if err != nil && err != ErrKeyNotExist {
+			return evicted, err
+		}
+		n.logf("Evicting key %q (%d bytes, last accessed %s).", u.key, u.size, u.accessed)
+		if err := remover.Remove(u.key); err != nil && err != ErrKeyNotExist {
+			return evicted, err
+		}
+		// If this node was the key's last replica, remove the key from the
+		// registry, so that the balancer doesn't register it to a node
+		// (probably this one) again.
+		if err := n.registry.deleteIfUnregistered(u.key); err != nil {
+			return evicted, err
+		}
+		n.accessMu.Lock()
+		delete(n.accessed, unslash(u.key))
+		n.accessMu.Unlock()
+		n.evictedMu.Lock()
+		if n.evicted == nil {
+			n.evicted = map[string]time.Time{}
+		}
+		n.evicted[keyPathJoin(u.key)] = time.Now()
+		n.evictedMu.Unlock()
+
+		total -= u.size
+		evicted++
+	}
+	if total > n.MaxBytes {
+		n.logf("Data size (%d bytes) still exceeds the maximum (%d bytes) after evicting %d keys; other keys can't be evicted yet.", total, n.MaxBytes, evicted)
+	}
+	// Publish the evicted keys (so that they aren't registered to this node
+	// again) along with whether the data still exceeds MaxBytes.
+	n.setOverMaxBytes(total > n.MaxBytes, evicted > 0)
+	return evicted, nil
+}
+
+// setOverMaxBytes records whether this node's data exceeds n.MaxBytes (in
+// which case it doesn't accept new keys), and publishes the change to the
+// cluster if it changed (or if publish is true).
+func (n *Node) setOverMaxBytes(over, publish bool) {
+	n.infoMu.Lock()
+	changed := n.overMaxBytes != over
+	n.overMaxBytes = over
+	n.infoMu.Unlock()
+
+	if changed || publish {
+		if err := n.publishInfoIfMember(); err != nil {
+			n.logf("Error publishing node %s info: %s.", n.Name, err)
+		}
+	}
+}
+
+// recentlyEvicted returns the keys that this node evicted within the last
+// n.EvictionCooldown.
+func (n *Node) recentlyEvicted() []string {
+	cooldown := n.EvictionCooldown
+	if cooldown == 0 {
+		cooldown = DefaultEvictionCooldown
+	}
+
+	n.evictedMu.Lock()
+	defer n.evictedMu.Unlock()
+	var keys []string
+	for key, t := range n.evicted {
+		if time.Since(t) > cooldown {
+			delete(n.evicted, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// canEvict reports whether this node may evict key: whether key is not
+// pinned, whether this node has fetched key, and whether enough other nodes
+// have key's data to satisfy n.Replication.Minimum.
+func (n *Node) canEvict(key string) (bool, error) {
+	if pinned, err := n.registry.IsPinned(key); err != nil || pinned {
+		return false, err
+	}
+	statuses, err := n.registry.Statuses(key)
+	if err != nil {
+		return false, err
+	}
+	if !statuses[n.Name].Ready() {
+		return false, nil
+	}
+	others := 0
+	for node, status := range statuses {
+		if node != n.Name && status.Ready() {
+			others++
+		}
+	}
+	return others >= n.Replication.Minimum, nil
+}
@@ -0,0 +1,155 @@
+package datad
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNode_EvictLRU(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	p := statingProvider{removingProvider{noopUpdateProvider{data{
+		"/a": {"0123456789"},
+		"/b": {"0123456789"},
+		"/c": {"0123456789"},
+		"/d": {"0123456789"},
+	}}, make(chan string, 10)}}
+	n := NewNode("n:80", b, p)
+	n.MaxBytes = 25
+	n.Replication.Minimum = 1
+
+	ready := RegistrationStatus{State: StateReady}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		must(t, r.add(key, n.Name, ready, ReasonExisting))
+	}
+	// "d" is only on this node, so it may not be evicted (given the
+	// minimum of 1).
+	for _, key := range []string{"a", "b", "c"} {
+		must(t, r.add(key, "other:80", ready, ReasonAssigned))
+	}
+
+	// Access "d" least recently, then "b", "c", and "a".
+	for _, key := range []string{"d", "b", "c", "a"} {
+		n.RecordAccess(key)
+		time.Sleep(time.Millisecond)
+	}
+
+	evicted, err := n.evictLRU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 2 {
+		t.Errorf("got %d evicted keys, want 2", evicted)
+	}
+	keys, err := r.KeysForNode(n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if want := []string{"a", "d"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v registered after eviction, want %v", keys, want)
+	}
+	for _, key := range []string{"/b", "/c"} {
+		if _, err := p.HasKey(key); err != ErrKeyNotExist {
+			t.Errorf("got HasKey error %v for evicted key %q, want ErrKeyNotExist", err, key)
+		}
+	}
+
+	// The data now fits, so nothing else is evicted.
+	if evicted, err := n.evictLRU(); err != nil || evicted != 0 {
+		t.Errorf("got %d evicted keys, %v when data fits, want 0", evicted, err)
+	}
+}
+
+// Test that the balancer doesn't register evicted keys again, and that a node
+// doesn't accept new keys while its data exceeds MaxBytes.
+func TestNode_EvictLRU_Balance(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	c := NewClient(b)
+
+	p := statingProvider{removingProvider{noopUpdateProvider{data{
+		"/a": {"0123456789"},
+		"/p": {"0123456789"},
+	}}, make(chan string, 10)}}
+	n := NewNode("n:80", b, p)
+	n.MaxBytes = 5
+	must(t, n.refreshClusterMembership())
+	if leader, err := n.campaign(); err != nil || !leader {
+		t.Fatalf("got campaign == %v, %v, want leader", leader, err)
+	}
+
+	// "a" is only on this node, but the minimum is 0, so it is evicted.
+	ready := RegistrationStatus{State: StateReady}
+	must(t, r.add("a", n.Name, ready, ReasonExisting))
+	if evicted, err := n.evictLRU(); err != nil || evicted != 1 {
+		t.Fatalf("got evictLRU == %d, %v, want 1 evicted", evicted, err)
+	}
+	if info, err := c.NodeInfo(n.Name); err != nil || !info.Accepting {
+		t.Errorf("got node info %+v, %v after eviction, want accepting", info, err)
+	}
+	must(t, n.balance())
+	if nodes, err := r.NodesForKey("a"); err != nil || len(nodes) != 0 {
+		t.Errorf("got NodesForKey == %v, %v after balance, want no nodes", nodes, err)
+	}
+
+	// The pinned key "p" can't be evicted, so the data still exceeds
+	// MaxBytes.
+	must(t, r.Pin("p"))
+	must(t, r.add("p", n.Name, ready, ReasonExisting))
+	if evicted, err := n.evictLRU(); err != nil || evicted != 0 {
+		t.Fatalf("got evictLRU == %d, %v, want 0 evicted", evicted, err)
+	}
+	if info, err := c.NodeInfo(n.Name); err != nil || info.Accepting {
+		t.Errorf("got node info %+v, %v while over MaxBytes, want not accepting", info, err)
+	}
+}
+
+// Test that the balancer doesn't register an evicted key that needs more
+// replicas to the node that evicted it (which would just evict it again).
+func TestNode_EvictLRU_Cooldown(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ds.Close()
+	other := cleanNodeName(ds.URL)
+
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	p := statingProvider{removingProvider{noopUpdateProvider{data{
+		"/a": {"0123456789"},
+	}}, make(chan string, 10)}}
+	n := NewNode("n:80", b, p)
+	n.MaxBytes = 5
+	n.Replication.Default = 2
+	must(t, n.refreshClusterMembership())
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, other), 0))
+	if leader, err := n.campaign(); err != nil || !leader {
+		t.Fatalf("got campaign == %v, %v, want leader", leader, err)
+	}
+
+	ready := RegistrationStatus{State: StateReady}
+	must(t, r.add("a", n.Name, ready, ReasonExisting))
+	must(t, r.add("a", other, ready, ReasonAssigned))
+	if evicted, err := n.evictLRU(); err != nil || evicted != 1 {
+		t.Fatalf("got evictLRU == %d, %v, want 1 evicted", evicted, err)
+	}
+
+	// The node accepts keys again, but not "a".
+	must(t, n.balance())
+	if nodes, err := r.NodesForKey("a"); err != nil || !reflect.DeepEqual(nodes, []string{other}) {
+		t.Errorf("got NodesForKey == %v, %v after balance, want [%s]", nodes, err, other)
+	}
+
+	// After the cooldown, "a" may be registered to the node again.
+	n.EvictionCooldown = time.Nanosecond
+	must(t, n.publishInfo())
+	must(t, n.balance())
+	if nodes, err := r.NodesForKey("a"); err != nil || len(nodes) != 2 {
+		t.Errorf("got NodesForKey == %v, %v after the cooldown, want 2 nodes", nodes, err)
+	}
+}
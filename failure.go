@@ -0,0 +1,102 @@
+package datad
+
+import "net/http"
+
+// A Failure classifies the outcome of a request that a KeyTransport made to
+// one of a key's nodes.
+type Failure int
+
+const (
+	// NoFailure means that the node responded successfully.
+	NoFailure Failure = iota
+
+	// ApplicationFailure means that the node and its data source work, but
+	// the request failed (e.g., with a 404 for a path within the key that
+	// doesn't exist). The response (or error) is returned to the caller.
+	ApplicationFailure
+
+	// NodeFailure means that the node or its data source can't serve the
+	// key's data. The node is deregistered from the key, and the request is
+	// retried on the key's other nodes.
+	NodeFailure
+)
+
+// A FailureClassifier classifies the outcome of each request that a
+// KeyTransport makes to one of a key's nodes, given the node's response or
+// the error from the underlying transport.
+type FailureClassifier interface {
+	Classify(resp *http.Response, err error) Failure
+}
+
+// FailureHeader is the response header by which a node's data source may
+// classify its own failed responses (for the StatusClassifier whose Header is
+// FailureHeader, which is the default). Its value is "node" for a
+// NodeFailure (e.g., because the data source doesn't have the key's data), or
+// "application" for an ApplicationFailure.
+const FailureHeader = "X-Datad-Failure"
+
+// DefaultFailureClassifier is the FailureClassifier used by clients whose
+// FailureClassifier is nil. Errors from the underlying transport and 5xx
+// responses are node failures, and other 4xx responses are application
+// failures, unless the response's FailureHeader says otherwise. (Clients
+// that use it also treat a 404 response for a key's root path as a node
+// failure, since it means that the node doesn't have the key's data.)
+var DefaultFailureClassifier FailureClassifier = &StatusClassifier{Header: FailureHeader}
+
+// StatusClassifier is a FailureClassifier that classifies responses by their
+// status code (or by a header set by the node), and errors by a func.
+type StatusClassifier struct {
+	// NodeFailureStatuses are the response status codes (of 400 or more)
+	// that mean node failures. Other status codes of 400 or more mean
+	// application failures. If nil, 5xx status codes mean node failures.
+	NodeFailureStatuses map[int]bool
+
+	// Header, if set, is a response header whose value ("node" or
+	// "application") classifies the response, regardless of its status
+	// code.
+	Header string
+
+	// IsNodeError reports whether err, an error from the underlying
+	// transport, means a node failure (otherwise, err is returned to the
+	// caller). If nil, all errors mean node failures.
+	IsNodeError func(err error) bool
+}
+
+func (c *StatusClassifier) Classify(resp *http.Response, err error) Failure {
+	if err != nil {
+		if c.IsNodeError == nil || c.IsNodeError(err) {
+			return NodeFailure
+		}
+		return ApplicationFailure
+	}
+
+	if c.Header != "" {
+		switch resp.Header.Get(c.Header) {
+		case "node":
+			return NodeFailure
+		case "application":
+			return ApplicationFailure
+		}
+	}
+
+	switch {
+	case resp.StatusCode < 400:
+		return NoFailure
+	case c.NodeFailureStatuses != nil:
+		if c.NodeFailureStatuses[resp.StatusCode] {
+			return NodeFailure
+		}
+		return ApplicationFailure
+	case resp.StatusCode >= 500:
+		return NodeFailure
+	default:
+		return ApplicationFailure
+	}
+}
+
+func (c *Client) failureClassifier() FailureClassifier {
+	if c.FailureClassifier != nil {
+		return c.FailureClassifier
+	}
+	return DefaultFailureClassifier
+}
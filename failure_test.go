@@ -0,0 +1,167 @@
+package datad
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStatusClassifier(t *testing.T) {
+	errTimeout := errors.New("timeout")
+	resp := func(status int, header string) *http.Response {
+		r := &http.Response{StatusCode: status, Header: http.Header{}}
+		if header != "" {
+			r.Header.Set(FailureHeader, header)
+		}
+		return r
+	}
+
+	tests := []struct {
+		classifier *StatusClassifier
+		resp       *http.Response
+		err        error
+		want       Failure
+	}{
+		{&StatusClassifier{}, resp(200, ""), nil, NoFailure},
+		{&StatusClassifier{}, resp(304, ""), nil, NoFailure},
+		{&StatusClassifier{}, resp(404, ""), nil, ApplicationFailure},
+		{&StatusClassifier{}, resp(500, ""), nil, NodeFailure},
+		{&StatusClassifier{}, nil, errTimeout, NodeFailure},
+		{&StatusClassifier{}, resp(404, "node"), nil, ApplicationFailure}, // header not used
+		{&StatusClassifier{Header: FailureHeader}, resp(404, "node"), nil, NodeFailure},
+		{&StatusClassifier{Header: FailureHeader}, resp(503, "application"), nil, ApplicationFailure},
+		{&StatusClassifier{NodeFailureStatuses: map[int]bool{404: true}}, resp(404, ""), nil, NodeFailure},
+		{&StatusClassifier{NodeFailureStatuses: map[int]bool{404: true}}, resp(500, ""), nil, ApplicationFailure},
+		{&StatusClassifier{IsNodeError: func(err error) bool { return err != errTimeout }}, nil, errTimeout, ApplicationFailure},
+	}
+	for i, test := range tests {
+		if got := test.classifier.Classify(test.resp, test.err); got != test.want {
+			t.Errorf("#%d: got %v, want %v", i, got, test.want)
+		}
+	}
+}
+
+// Test that KeyTransport deregisters nodes only for node failures, and
+// returns application failures to the caller.
+func TestKeyTransport_FailureClassifier(t *testing.T) {
+	tests := map[string]struct {
+		handler        http.HandlerFunc
+		path           string
+		wantStatus     int
+		wantDeregister bool
+	}{
+		"404": {
+			handler:    func(w http.ResponseWriter, r *http.Request) { http.Error(w, "no such file", http.StatusNotFound) },
+			wantStatus: http.StatusNotFound,
+		},
+		"404 on key root": {
+			handler:        func(w http.ResponseWriter, r *http.Request) { http.Error(w, "key not found", http.StatusNotFound) },
+			path:           "/k",
+			wantDeregister: true,
+		},
+		"404 node failure": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(FailureHeader, "node")
+				http.Error(w, "key not found", http.StatusNotFound)
+			},
+			wantDeregister: true,
+		},
+		"500": {
+			handler:        func(w http.ResponseWriter, r *http.Request) { http.Error(w, "broken", http.StatusInternalServerError) },
+			wantDeregister: true,
+		},
+	}
+	for label, test := range tests {
+		ds := httptest.NewServer(test.handler)
+		defer ds.Close()
+
+		c := NewClient(NewMemoryBackend())
+		node := cleanNodeName(ds.URL)
+		must(t, c.registry.add("k", node, RegistrationStatus{State: StateReady}, ReasonAssigned))
+		transport, err := c.TransportForKey("k", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := test.path
+		if path == "" {
+			path = "/k/file"
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(path)
+		if test.wantDeregister {
+			if err == nil {
+				t.Errorf("%s: got no error, want a node failure", label)
+			}
+		} else if err != nil || resp.StatusCode != test.wantStatus {
+			t.Errorf("%s: got response %v, error %v, want status %d", label, resp, err, test.wantStatus)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		nodes, err := c.NodesForKey("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deregistered := len(nodes) == 0; deregistered != test.wantDeregister {
+			t.Errorf("%s: got NodesForKey == %v, want deregistered == %v", label, nodes, test.wantDeregister)
+		}
+	}
+}
+
+// Test that the balancer's liveness check deregisters nodes that fail to
+// serve a key's root, even if the failure is not a node failure.
+func TestNode_Balance_Liveness(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(status), status)
+		}))
+		defer ds.Close()
+		node := cleanNodeName(ds.URL)
+
+		b := NewMemoryBackend()
+		c := NewClient(b)
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+		must(t, c.registry.add("k", node, RegistrationStatus{State: StateReady}, ReasonAssigned))
+
+		n := NewNode("n:80", b, NoopProvider{})
+		if leader, err := n.campaign(); err != nil || !leader {
+			t.Fatalf("got campaign == %v, %v, want leader", leader, err)
+		}
+		must(t, n.balance())
+		if nodes, err := c.NodesForKey("k"); err != nil || len(nodes) != 0 {
+			t.Errorf("status %d: got NodesForKey == %v, %v after balance, want the node deregistered", status, nodes, err)
+		}
+	}
+}
+
+// Test that KeyTransport returns application failures without reading the
+// node's registration status from the registry.
+func TestKeyTransport_ApplicationFailure_NoStatus(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such file", http.StatusNotFound)
+	}))
+	defer ds.Close()
+
+	b := &getCountingBackend{MemoryBackend: NewMemoryBackend()}
+	c := NewClient(b)
+	must(t, c.registry.add("k", cleanNodeName(ds.URL), RegistrationStatus{State: StateReady}, ReasonAssigned))
+	transport, err := c.TransportForKey("k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := atomic.LoadInt32(&b.gets)
+	resp, err := (&http.Client{Transport: transport}).Get("/k/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if gets := atomic.LoadInt32(&b.gets) - before; gets != 0 {
+		t.Errorf("got %d backend Gets for an application failure, want 0", gets)
+	}
+}
@@ -0,0 +1,301 @@
+package datad
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// fileBackendCompactMin is the minimum number of records that a FileBackend's
+// log must contain before it is compacted while open.
+const fileBackendCompactMin = 10000
+
+// A FileBackend is a Backend that keeps all keys in memory (like
+// MemoryBackend) and appends each change to a log file on local disk, so that
+// its contents survive restarts. It lets datad run as a standalone cluster of
+// one, with no coordination service. Directory TTLs are stored as absolute
+// expiration times, so (e.g.) the cluster memberships of nodes that stopped
+// while the process was down have expired when it restarts.
+//
+// The log is compacted when it is opened and whenever it grows much larger
+// than the data it describes. Changes are written to the file as they are
+// made but are not synced to disk, so they survive the process crashing but
+// not necessarily the machine crashing.
+//
+// A FileBackend may be shared by any number of Nodes and Clients in the same
+// process, but a file must not be opened by more than one FileBackend at a
+// time.
+type FileBackend struct {
+	*MemoryBackend
+
+	path string
+	f    *os.File
+
+	// records is the number of records in the log file, and compactAt is the
+	// number of records at which it will next be compacted.
+	records, compactAt int
+}
+
+const (
+	// fileIndexAction is the action of a record that sets the current
+	// modification index without changing any keys.
+	fileIndexAction WatchAction = "index"
+
+	// fileTxnAction is the action of a record that holds all of the changes
+	// made by a transaction.
+	fileTxnAction WatchAction = "txn"
+)
+
+// fileRecord is a single change in a FileBackend's log.
+type fileRecord struct {
+	Action WatchAction `json:"a"`
+	Key    string      `json:"k"`
+	Value  string      `json:"v,omitempty"`
+	Dir    bool        `json:"d,omitempty"`
+	Index  uint64      `json:"i"`
+
+	// Expiration is the time (in Unix nanoseconds) at which the key expires,
+	// or 0 if it has no TTL.
+	Expiration int64 `json:"e,omitempty"`
+
+	// Txn holds the changes of a fileTxnAction record.
+	Txn []fileRecord `json:"t,omitempty"`
+}
+
+// NewFileBackend opens the backend stored in the file at path, creating the
+// file if it does not exist.
+func NewFileBackend(path string) (*FileBackend, error) {
+	b := &FileBackend{MemoryBackend: NewMemoryBackend(), path: path}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+	b.persist = b.append
+	return b, nil
+}
+
+// Close closes the log file. The backend must not be modified after it is
+// closed.
+func (b *FileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.f.Close()
+}
+
+// load replays the log file's records. The caller must hold b.mu.
+func (b *FileBackend) load() error {
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Expirations are applied after all records are replayed, so that keys
+	// aren't expired based on the current time before later records (that
+	// were written while they were still alive) are replayed.
+	expirations := make(map[*memNode]time.Time)
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 64*1024*1024)
+	var torn error
+	for line := 1; s.Scan(); line++ {
+		if torn != nil {
+			// Only the last record may be incomplete (if the process crashed
+			// while writing it).
+			return torn
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			torn = fmt.Errorf("%s:%d: %s", b.path, line, err)
+			continue
+		}
+		if err := b.apply(&rec, expirations); err != nil {
+			return fmt.Errorf("%s:%d: %s", b.path, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	for n, exp := range expirations {
+		b.setExpiration(n, exp)
+	}
+	b.history = nil
+	return nil
+}
+
+// apply applies a record from the log file. The caller must hold b.mu.
+func (b *FileBackend) apply(rec *fileRecord, expirations map[*memNode]time.Time) error {
+	switch rec.Action {
+	case WatchSet, WatchUpdate:
+		n, _, err := b.create(rec.Key, rec.Dir)
+		if err != nil {
+			return err
+		}
+		if n.dir != rec.Dir {
+			b.remove(n)
+			if n, _, err = b.create(rec.Key, rec.Dir); err != nil {
+				return err
+			}
+		}
+		n.value = rec.Value
+		n.index = rec.Index
+		if rec.Expiration != 0 {
+			expirations[n] = time.Unix(0, rec.Expiration)
+		} else {
+			delete(expirations, n)
+		}
+	case WatchDelete, WatchExpire:
+		if n := b.lookup(rec.Key); n != nil {
+			b.remove(n)
+		}
+	case fileTxnAction:
+		for i := range rec.Txn {
+			if err := b.apply(&rec.Txn[i], expirations); err != nil {
+				return err
+			}
+		}
+	case fileIndexAction:
+	default:
+		return fmt.Errorf("unknown action %q", rec.Action)
+	}
+	b.index = rec.Index
+	return nil
+}
+
+// append writes changes to the log file. The changes of a transaction are
+// written as a single record, so that they are either all logged or (if the
+// process crashes while writing it) all discarded as a torn record when the
+// log is loaded. The caller must hold b.mu.
+func (b *FileBackend) append(changes []memChange) error {
+	recs := make([]fileRecord, len(changes))
+	for i, c := range changes {
+		recs[i] = newFileRecord(c.ev, c.expiration)
+	}
+	rec := recs[0]
+	if len(recs) > 1 {
+		rec = fileRecord{Action: fileTxnAction, Index: recs[len(recs)-1].Index, Txn: recs}
+	}
+	if err := writeFileRecord(b.f, &rec); err != nil {
+		return err
+	}
+	b.records++
+	if b.records >= b.compactAt {
+		return b.compact()
+	}
+	return nil
+}
+
+func (b *FileBackend) write(f *os.File, ev *WatchEvent, expiration time.Time) error {
+	rec := newFileRecord(ev, expiration)
+	return writeFileRecord(f, &rec)
+}
+
+func newFileRecord(ev *WatchEvent, expiration time.Time) fileRecord {
+	rec := fileRecord{Action: ev.Action, Key: ev.Key, Value: ev.Value, Dir: ev.Dir, Index: ev.Index}
+	if !expiration.IsZero() {
+		rec.Expiration = expiration.UnixNano()
+	}
+	return rec
+}
+
+func writeFileRecord(f *os.File, rec *fileRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// compact replaces the log file with one that contains a single record for
+// each key that currently exists, and reopens it for appending. The caller
+// must hold b.mu.
+func (b *FileBackend) compact() error {
+	tmpPath := b.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	now := time.Now()
+	records := 0
+	var walk func(n *memNode) error
+	walk = func(n *memNode) error {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child := n.children[name]
+			if !child.expiration.IsZero() && !now.Before(child.expiration) {
+				continue
+			}
+			ev := &WatchEvent{Action: WatchSet, Key: child.key(), Value: child.value, Dir: child.dir, Index: child.index}
+			if err := b.write(tmp, ev, child.expiration); err != nil {
+				return err
+			}
+			records++
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(b.root); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Record the current index, which may be greater than that of any
+	// remaining key, so that indexes keep increasing after a restart.
+	if b.index > 0 {
+		ev := &WatchEvent{Action: fileIndexAction, Index: b.index}
+		if err := b.write(tmp, ev, time.Time{}); err != nil {
+			tmp.Close()
+			return err
+		}
+		records++
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if b.f != nil {
+		b.f.Close()
+	}
+	b.f = f
+
+	b.records = records
+	b.compactAt = 2 * records
+	if b.compactAt < fileBackendCompactMin {
+		b.compactAt = fileBackendCompactMin
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package datad
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func withFileBackend(t *testing.T, f func(path string)) {
+	tmpdir, err := ioutil.TempDir("", "datad-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	f(filepath.Join(tmpdir, "datad.log"))
+}
+
+func TestFileBackend(t *testing.T) {
+	withFileBackend(t, func(path string) {
+		b, err := NewFileBackend(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		testBackend(t, b)
+		testBackendWatch(t, b)
+		testBackendCompareAndSwap(t, b)
+		testBackendTxn(t, b)
+	})
+}
+
+func TestFileBackend_DirTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires at least 1s sleep")
+	}
+
+	withFileBackend(t, func(path string) {
+		b, err := NewFileBackend(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		testBackendDirTTL(t, b, 1)
+	})
+}
+
+func TestFileBackend_Reopen(t *testing.T) {
+	withFileBackend(t, func(path string) {
+		b, err := NewFileBackend(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		must(t, b.Set("a/b", "1"))
+		must(t, b.Set("a/c", "2"))
+		must(t, b.Delete("a/c"))
+		must(t, b.SetDir("nodes/n", 60))
+		must(t, b.Set("x", "3"))
+		must(t, b.Delete("x"))
+		must(t, b.Txn([]TxnOp{{Type: TxnSet, Key: "t/1"}, {Type: TxnCreate, Key: "t/2"}}))
+		index := b.index
+		must(t, b.Close())
+
+		// Simulate a crash in the middle of writing a record.
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(`{"a":"set","k":"/tor`)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		b, err = NewFileBackend(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		keys, err := b.List("", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a", "a/b", "nodes", "nodes/n", "t", "t/1", "t/2"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("got keys == %v, want %v", keys, want)
+		}
+		if v, err := b.Get("a/b"); err != nil || v != "1" {
+			t.Errorf("got Get == %q, %v, want %q", v, err, "1")
+		}
+		if err := b.SetDir("nodes/n", 60); err != ErrKeyExists {
+			t.Errorf("got SetDir error %v, want ErrKeyExists (TTL should not have elapsed)", err)
+		}
+		if b.index != index {
+			t.Errorf("got index %d after reopening, want %d", b.index, index)
+		}
+	})
+}
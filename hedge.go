@@ -0,0 +1,85 @@
+package datad
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// hedgeLatencySamples is the number of recent request latencies that
+	// each client keeps for computing Client.HedgePercentile.
+	hedgeLatencySamples = 100
+
+	// hedgeMinLatencySamples is the number of latencies that a client must
+	// observe before it uses Client.HedgePercentile (instead of
+	// Client.HedgeDelay).
+	hedgeMinLatencySamples = 20
+)
+
+// latencyWindow holds a client's recent request latencies.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int // index of the oldest sample (when full)
+}
+
+func (w *latencyWindow) record(d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < hedgeLatencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % len(w.samples)
+}
+
+// percentile returns the pth percentile (0 < p <= 100) of the recorded
+// latencies, or false if too few latencies have been recorded.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration{}, w.samples...)
+	w.mu.Unlock()
+	if len(sorted) < hedgeMinLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// hedgeDelay returns how long a KeyTransport waits for a node to respond
+// before also sending the request to the next node, or 0 if requests are not
+// hedged.
+func (c *Client) hedgeDelay() time.Duration {
+	if c.HedgePercentile > 0 && c.latencies != nil {
+		if d, ok := c.latencies.percentile(c.HedgePercentile); ok {
+			return d
+		}
+	}
+	return c.HedgeDelay
+}
+
+// cancelOnClose cancels the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,104 @@
+package datad
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow_Percentile(t *testing.T) {
+	w := &latencyWindow{}
+	if _, ok := w.percentile(50); ok {
+		t.Error("got ok with no samples, want !ok")
+	}
+
+	for i := 1; i <= hedgeLatencySamples; i++ {
+		w.record(time.Duration(i) * time.Millisecond)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{1, 1 * time.Millisecond},
+		{50, 50 * time.Millisecond},
+		{95, 95 * time.Millisecond},
+		{100, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got, ok := w.percentile(test.p); !ok || got != test.want {
+			t.Errorf("p%v: got %s (ok=%v), want %s", test.p, got, ok, test.want)
+		}
+	}
+
+	// Old samples are replaced by new ones.
+	for i := 0; i < hedgeLatencySamples; i++ {
+		w.record(time.Second)
+	}
+	if got, _ := w.percentile(1); got != time.Second {
+		t.Errorf("after replacing samples: got p1 %s, want %s", got, time.Second)
+	}
+}
+
+// Test that a hedged KeyTransport request is also sent to the key's next node
+// when the first node is slow, and that the slow request is canceled.
+func TestKeyTransport_Hedge(t *testing.T) {
+	slowCanceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(slowCanceled)
+		case <-time.After(5 * time.Second):
+			w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	c := NewClient(NewMemoryBackend())
+	c.HedgeDelay = 20 * time.Millisecond
+	slowNode, fastNode := cleanNodeName(slow.URL), cleanNodeName(fast.URL)
+	must(t, c.registry.add("k", slowNode, RegistrationStatus{State: StateReady}, ReasonAssigned))
+	must(t, c.registry.add("k", fastNode, RegistrationStatus{State: StateReady}, ReasonAssigned))
+	transport, err := c.TransportForKey("k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.nodes = []string{slowNode, fastNode}
+
+	start := time.Now()
+	resp, err := (&http.Client{Transport: transport}).Get("/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "fast" {
+		t.Errorf("got body %q, want %q", body, "fast")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got response after %s, want it soon after the hedge delay", elapsed)
+	}
+
+	select {
+	case <-slowCanceled:
+	case <-time.After(time.Second):
+		t.Error("slow node's request was not canceled")
+	}
+
+	// The slow node was not deregistered.
+	nodes, err := c.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsString(nodes, slowNode) {
+		t.Errorf("got nodes %v, want slow node %q still registered", nodes, slowNode)
+	}
+}
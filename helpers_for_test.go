@@ -1,10 +1,14 @@
 package datad
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type datum struct{ value string }
@@ -77,6 +81,100 @@ func (p fakeUpdateProvider) Update(key string) error {
 	return nil
 }
 
+type blockingProvider struct {
+	data
+	unblock chan error
+}
+
+func (p blockingProvider) Update(key string) error {
+	if err := <-p.unblock; err != nil {
+		return err
+	}
+	p.data[slash(key)] = datum{value: "val"}
+	return nil
+}
+
+type walkingProvider struct {
+	noopUpdateProvider
+	onKey func(i int)
+}
+
+func (p walkingProvider) WalkKeys(keyPrefix string, fn func(key string) error) error {
+	keys, err := p.Keys(keyPrefix)
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+		if p.onKey != nil {
+			p.onKey(i)
+		}
+	}
+	return nil
+}
+
+type countingProvider struct {
+	noopUpdateProvider
+	updates chan string
+}
+
+func (p countingProvider) Update(key string) error {
+	p.updates <- key
+	return p.noopUpdateProvider.Update(key)
+}
+
+type removingProvider struct {
+	noopUpdateProvider
+	removed chan string
+}
+
+func (p removingProvider) Remove(key string) error {
+	if _, err := p.HasKey(key); err != nil {
+		return err
+	}
+	delete(p.data, slash(key))
+	p.removed <- key
+	return nil
+}
+
+type statingProvider struct {
+	removingProvider
+}
+
+func (p statingProvider) Stat(key string) (*KeyStat, error) {
+	d, present := p.data[slash(key)]
+	if !present {
+		return nil, ErrKeyNotExist
+	}
+	return &KeyStat{Size: uint64(len(d.value))}, nil
+}
+
+type cancelableProvider struct {
+	noopUpdateProvider
+	started  chan string
+	canceled chan string
+}
+
+func (p cancelableProvider) Update(key string) error {
+	return p.UpdateContext(context.Background(), key)
+}
+
+func (p cancelableProvider) UpdateContext(ctx context.Context, key string) error {
+	p.started <- key
+	<-ctx.Done()
+	p.canceled <- key
+	return ctx.Err()
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("failed")
+}
+
 type dataHandler map[string]datum
 
 func (h dataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -93,3 +191,28 @@ type NoopProvider struct{}
 func (_ NoopProvider) HasKey(key string) (bool, error)         { return false, nil }
 func (_ NoopProvider) Keys(keyPrefix string) ([]string, error) { return nil, nil }
 func (_ NoopProvider) Update(key string) error                 { return nil }
+
+type listHookBackend struct {
+	*MemoryBackend
+	afterList func()
+}
+
+func (b *listHookBackend) List(key string, recursive bool) ([]string, error) {
+	names, err := b.MemoryBackend.List(key, recursive)
+	if b.afterList != nil {
+		hook := b.afterList
+		b.afterList = nil
+		hook()
+	}
+	return names, err
+}
+
+type getCountingBackend struct {
+	*MemoryBackend
+	gets int32
+}
+
+func (b *getCountingBackend) Get(key string) (string, error) {
+	atomic.AddInt32(&b.gets, 1)
+	return b.MemoryBackend.Get(key)
+}
@@ -1,9 +1,13 @@
 package datad
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
@@ -158,6 +162,44 @@ func TestIntegration_Update_CreateKey(t *testing.T) {
 	})
 }
 
+// Test that a node watches its registered keys on a backend other than etcd.
+func TestIntegration_MemoryBackend_Update_CreateKey(t *testing.T) {
+	b := NewMemoryBackend()
+
+	data := data{}
+
+	ds := httptest.NewServer(dataHandler(data))
+	defer ds.Close()
+
+	n := NewNode(ds.URL, b, fakeUpdateProvider{data: data})
+	must(t, n.Start())
+	defer n.Stop()
+
+	// Give the node's registry watcher time to start.
+	time.Sleep(50 * time.Millisecond)
+
+	c := NewClient(b)
+
+	nodes, err := c.Update("/newkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{n.Name}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	transport, err := c.TransportForKey("/newkey", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httpGet("", t, transport, "/newkey")
+	if want := "val0"; resp != want {
+		t.Errorf("got response == %q, want %q", resp, want)
+	}
+}
+
 // Test that a key is updated.
 func TestIntegration_Update_UpdateKey(t *testing.T) {
 	withEtcd(t, func(ec *etcd_client.Client) {
@@ -370,7 +412,9 @@ func TestIntegration_Balance_RegisterUnregisteredKeys(t *testing.T) {
 			t.Errorf("got NodesForKey == %v, want empty", nodes)
 		}
 
-		// Trigger a balance on the live node.
+		// Trigger a balance on the live node (which is the leader, since it
+		// is the only node).
+		waitForLeader(t, n)
 		err = n.balance()
 		if err != nil {
 			t.Fatal(err)
@@ -525,6 +569,341 @@ func TestIntegration_Balance_RegisterUnregisteredKeys(t *testing.T) {
 // 	}
 // }
 
+// Test that a key transport doesn't deregister a node that is still
+// fetching the key.
+func TestIntegration_MemoryBackend_NotReady(t *testing.T) {
+	b := NewMemoryBackend()
+
+	data := data{}
+	ds := httptest.NewServer(dataHandler(data))
+	defer ds.Close()
+
+	p := blockingProvider{data: data, unblock: make(chan error)}
+	n := NewNode(ds.URL, b, p)
+	must(t, n.Start())
+	defer n.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	c := NewClient(b)
+	if _, err := c.Update("/k"); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus := func(want RegistrationState) {
+		for i := 0; i < 100; i++ {
+			if s, err := c.registry.Status("/k", n.Name); err == nil && s.State == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("key's status did not become %s", want)
+	}
+	waitForStatus(StateFetching)
+
+	transport, err := c.TransportForKey("/k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&http.Client{Transport: transport}).Get("/k")
+	if uerr, ok := err.(*url.Error); !ok || uerr.Err != ErrKeyNotReady {
+		t.Errorf("got error %v, want ErrKeyNotReady", err)
+	}
+	if nodes, err := c.NodesForKey("/k"); err != nil || len(nodes) != 1 {
+		t.Errorf("got NodesForKey == %v, %v, want the fetching node to remain registered", nodes, err)
+	}
+
+	p.unblock <- nil
+	waitForStatus(StateReady)
+	if resp := httpGet("", t, transport, "/k"); resp != "val" {
+		t.Errorf("got response == %q, want %q", resp, "val")
+	}
+
+	// A failed update of a ready key leaves it ready.
+	must(t, c.registry.RequestUpdate("/k", n.Name))
+	p.unblock <- errors.New("update failed")
+	for i := 0; i < 100; i++ {
+		if s, _ := c.registry.Status("/k", n.Name); s.Error != "" {
+			if s.State != StateReady {
+				t.Errorf("got status %+v after failed update, want ready", s)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("failed update was not recorded in status")
+}
+
+// Test that the balancer moves keys off nodes that have left the cluster, and
+// does not register keys to draining nodes.
+func TestIntegration_MemoryBackend_Balance_DeadNodes(t *testing.T) {
+	b := NewMemoryBackend()
+
+	data := data{}
+	ds := httptest.NewServer(dataHandler(data))
+	defer ds.Close()
+
+	n := NewNode(ds.URL, b, fakeUpdateProvider{data: data})
+	n.Replication.Default = 2
+	must(t, n.Start())
+	defer n.Stop()
+
+	// Simulate a draining node, which is a member of the cluster that does
+	// not accept new keys.
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, "draining:80"), 0))
+	must(t, b.Set(keyPathJoin(nodesPrefix, "draining:80", nodeInfoFile), `{"accepting":false,"draining":true}`))
+
+	// Simulate a node whose membership expired.
+	c := NewClient(b)
+	must(t, c.registry.Add("key", "deadnode:80"))
+
+	waitForLeader(t, n)
+	must(t, n.balance())
+
+	nodes, err := c.NodesForKey("/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{n.Name}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
+}
+
+// Test that a draining node hands off its keys to another node and leaves
+// the cluster.
+func TestIntegration_MemoryBackend_Drain(t *testing.T) {
+	origInterval := drainPollInterval
+	drainPollInterval = 10 * time.Millisecond
+	defer func() { drainPollInterval = origInterval }()
+
+	b := NewMemoryBackend()
+
+	data1 := data{"/key": {"val"}}
+	ds1 := httptest.NewServer(dataHandler(data1))
+	defer ds1.Close()
+	n1 := NewNode(ds1.URL, b, noopUpdateProvider{data1})
+
+	data2 := data{}
+	ds2 := httptest.NewServer(dataHandler(data2))
+	defer ds2.Close()
+	n2 := NewNode(ds2.URL, b, fakeUpdateProvider{data: data2})
+
+	must(t, n1.Start())
+	defer n1.Stop()
+	must(t, n2.Start())
+	defer n2.Stop()
+	must(t, n1.registerExistingKeys())
+
+	// Give the nodes' registry watchers time to start.
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	must(t, n1.Drain(ctx))
+
+	c := NewClient(b)
+	nodes, err := c.NodesForKey("/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{n2.Name}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
+	if status, err := c.registry.Status("/key", n2.Name); err != nil || !status.Ready() {
+		t.Errorf("got status %+v, %v on new node, want ready", status, err)
+	}
+	nodes, err = c.NodesInCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{n2.Name}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesInCluster == %v, want %v", nodes, want)
+	}
+	if keys, err := c.registry.KeysForNode(n1.Name); err != nil || len(keys) != 0 {
+		t.Errorf("got KeysForNode == %v, %v for drained node, want none", keys, err)
+	}
+}
+
+// Test that a draining node doesn't deregister a key that no other node is
+// registered to yet (e.g., because another caller holds the key's
+// registration lock), and that it accepts keys again if Drain fails.
+func TestIntegration_MemoryBackend_Drain_NotHandedOff(t *testing.T) {
+	origInterval := drainPollInterval
+	drainPollInterval = 10 * time.Millisecond
+	defer func() { drainPollInterval = origInterval }()
+
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n1 := NewNode("n1:80", b, NoopProvider{})
+	must(t, n1.refreshClusterMembership())
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, "n2:80"), 0))
+	must(t, c.registry.add("key", n1.Name, RegistrationStatus{State: StateReady}, ReasonExisting))
+
+	// Another caller is registering the key to n2:80.
+	lockKey := keyPathJoin(registryPrefix, keysPrefix, "key", keyLockFile)
+	if _, err := b.Create(lockKey, n1.Name+",n2:80", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n1.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got Drain error %v, want context.DeadlineExceeded", err)
+	}
+	if nodes, err := c.NodesForKey("key"); err != nil || !reflect.DeepEqual(nodes, []string{n1.Name}) {
+		t.Errorf("got NodesForKey == %v, %v, want [%s]", nodes, err, n1.Name)
+	}
+	if info, err := c.NodeInfo(n1.Name); err != nil || !info.Accepting || info.Draining {
+		t.Errorf("got node info %+v, %v after Drain failed, want accepting and not draining", info, err)
+	}
+
+	// Once the lock is released, the key is registered to n2:80 (which
+	// never fetches it, so Drain times out again).
+	must(t, b.Delete(lockKey))
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n1.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got Drain error %v, want context.DeadlineExceeded", err)
+	}
+	if nodes, err := c.NodesForKey("key"); err != nil || !containsString(nodes, "n2:80") {
+		t.Errorf("got NodesForKey == %v, %v after the lock was released, want n2:80 among them", nodes, err)
+	}
+}
+
+// Test that a node registers its provider's keys as they are found, if the
+// provider is a KeyWalker.
+func TestIntegration_MemoryBackend_WalkKeys(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	data := data{}
+	var keys []string
+	for i := 0; i < 2*registryBatchSize+10; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		data["/"+key] = datum{"val"}
+		keys = append(keys, key)
+	}
+
+	var n *Node
+	var registeredWhileWalking []string
+	p := walkingProvider{noopUpdateProvider{data}, func(i int) {
+		if i == registryBatchSize {
+			registeredWhileWalking, _ = r.KeysForNode(n.Name)
+		}
+	}}
+	n = NewNode("n:80", b, p)
+
+	must(t, n.registerExistingKeys())
+	if want := keys[:registryBatchSize]; !reflect.DeepEqual(registeredWhileWalking, want) {
+		t.Errorf("got %d keys registered while walking, want the first batch of %d", len(registeredWhileWalking), len(want))
+	}
+	registered, err := r.KeysForNode(n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(registered, keys) {
+		t.Errorf("got %d keys registered after walking, want %d", len(registered), len(keys))
+	}
+	if status, err := r.Status(keys[0], n.Name); err != nil || !status.Ready() {
+		t.Errorf("got status %+v, %v for existing key, want ready", status, err)
+	}
+
+	// Registering again leaves the keys registered.
+	must(t, n.registerExistingKeys())
+	if registered, err := r.KeysForNode(n.Name); err != nil || !reflect.DeepEqual(registered, keys) {
+		t.Errorf("got %d keys registered after walking again, want %d", len(registered), len(keys))
+	}
+
+	// Stopping the node stops the walk.
+	b2 := NewMemoryBackend()
+	p.onKey = func(i int) {
+		if i == 0 {
+			n.Stop()
+		}
+	}
+	n = NewNode("n:80", b2, p)
+	must(t, n.registerExistingKeys())
+	if registered, _ := NewRegistry(b2).KeysForNode(n.Name); len(registered) != 0 {
+		t.Errorf("got %d keys registered after stopping, want none", len(registered))
+	}
+}
+
+// Test that a node does not update the existing keys that it registers on
+// startup, but does update them when an update is requested.
+func TestIntegration_MemoryBackend_ExistingKeysNotUpdated(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	p := countingProvider{noopUpdateProvider{data{"/a": {"val"}, "/b": {"val"}}}, make(chan string, 10)}
+	n := NewNode("n:80", b, p)
+	must(t, n.Start())
+	defer n.Stop()
+
+	for i := 0; i < 100; i++ {
+		if keys, _ := r.KeysForNode(n.Name); len(keys) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case key := <-p.updates:
+		t.Fatalf("got update of existing key %q, want none", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	must(t, r.RequestUpdate("/a", n.Name))
+	select {
+	case key := <-p.updates:
+		if key != "a" && key != "/a" {
+			t.Errorf("got update of key %q, want %q", key, "/a")
+		}
+	case <-time.After(time.Second):
+		t.Error("requested update was not performed")
+	}
+}
+
+// Test that a node removes its data for keys that are deregistered from it,
+// unless they are registered to it again during the grace period.
+func TestIntegration_MemoryBackend_Eviction(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	p := removingProvider{noopUpdateProvider{data{"/a": {"val"}, "/b": {"val"}}}, make(chan string, 10)}
+	n := NewNode("n:80", b, p)
+	n.EvictionGracePeriod = 100 * time.Millisecond
+	must(t, n.Start())
+	defer n.Stop()
+
+	for i := 0; i < 100; i++ {
+		if keys, _ := r.KeysForNode(n.Name); len(keys) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Deregister both keys, but register "b" again before the grace period
+	// elapses.
+	must(t, r.Remove("/a", n.Name))
+	must(t, r.Remove("/b", n.Name))
+	time.Sleep(20 * time.Millisecond)
+	must(t, r.Add("/b", n.Name))
+
+	select {
+	case key := <-p.removed:
+		if unslash(key) != "a" {
+			t.Errorf("got removal of key %q, want %q", key, "/a")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("data for deregistered key was not removed")
+	}
+	select {
+	case key := <-p.removed:
+		t.Errorf("got removal of re-registered key %q, want none", key)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := p.HasKey("/b"); err != nil {
+		t.Errorf("got HasKey error %v for re-registered key, want nil", err)
+	}
+}
+
 func httpGet(label string, t *testing.T, transport http.RoundTripper, url string) string {
 	c := &http.Client{Transport: transport}
 	resp, err := c.Get(url)
@@ -0,0 +1,128 @@
+package datad
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LeaderLeaseTTL is the duration of the balancer leader's lease. The leader
+// renews its lease several times per TTL; if it stops renewing it (e.g.,
+// because it died), another node becomes the leader after the lease expires.
+var LeaderLeaseTTL = 30 * time.Second
+
+// leaderKey holds the name of the node that leads the balancing of the whole
+// keyspace. It is created with a TTL of LeaderLeaseTTL.
+const leaderKey = "/leader"
+
+// Leader returns the name of the node that is currently the balancer leader.
+// If there is no leader (e.g., because the last leader's lease expired and no
+// other node has taken over yet), ErrKeyNotExist is returned.
+func (c *Client) Leader() (string, error) {
+	return c.backend.Get(leaderKey)
+}
+
+// IsLeader reports whether this node is the balancer leader: whether its last
+// attempt to acquire or renew the lease succeeded, and the lease has not
+// expired since then (e.g., because renewing it failed or took too long).
+func (n *Node) IsLeader() bool {
+	deadline := atomic.LoadInt64(&n.leaseDeadline)
+	return deadline != 0 && time.Now().UnixNano() < deadline
+}
+
+// campaign tries to acquire the leader lease if no node holds it, or to renew
+// it if this node holds it. It returns whether this node holds the lease, and
+// it records when the lease expires (for IsLeader).
+func (n *Node) campaign() (bool, error) {
+	ttl := uint64(LeaderLeaseTTL / time.Second)
+
+	// The lease expires TTL after the backend receives the request, which
+	// is after start. Consider it expired a little earlier than that, in
+	// case this node's clock runs slower than the backend's.
+	start := time.Now()
+	lease := time.Duration(ttl) * time.Second
+	leader, err := n.acquireLease(ttl)
+	var deadline int64
+	if leader {
+		deadline = start.Add(lease - lease/10).UnixNano()
+	}
+	atomic.StoreInt64(&n.leaseDeadline, deadline)
+	return leader, err
+}
+
+// acquireLease acquires or renews the leader lease (with the given TTL, in
+// seconds) and returns whether this node holds it.
+func (n *Node) acquireLease(ttl uint64) (bool, error) {
+	leader, index, err := n.backend.GetIndex(leaderKey)
+	if err == ErrKeyNotExist {
+		_, err = n.backend.Create(leaderKey, n.Name, ttl)
+		if err == ErrKeyExists {
+			// Another node acquired it first.
+			return false, nil
+		}
+		return err == nil, err
+	} else if err != nil {
+		return false, err
+	}
+	if leader != n.Name {
+		return false, nil
+	}
+	_, err = n.backend.CompareAndSwap(leaderKey, n.Name, ttl, index)
+	if err == ErrCompareFailed || err == ErrKeyNotExist {
+		// The lease expired (and perhaps another node acquired it).
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// campaignPeriodically acquires or renews the leader lease several times per
+// LeaderLeaseTTL until this node is stopped, and then resigns.
+func (n *Node) campaignPeriodically() {
+	elect := func() {
+		wasLeader := n.IsLeader()
+		leader, err := n.campaign()
+		if err != nil {
+			n.logf("Error acquiring or renewing balancer leader lease: %s.", err)
+		}
+		if leader != wasLeader {
+			if leader {
+				n.logf("Became the balancer leader.")
+			} else {
+				n.logf("Lost the balancer leader lease.")
+			}
+		}
+	}
+
+	elect()
+	t := time.NewTicker(LeaderLeaseTTL / 3)
+	for {
+		select {
+		case <-t.C:
+			elect()
+		case <-n.stopChan:
+			t.Stop()
+			if err := n.resign(); err != nil {
+				n.logf("Error resigning as balancer leader: %s.", err)
+			}
+			return
+		}
+	}
+}
+
+// resign releases the leader lease if this node holds it, so that another
+// node can take over without waiting for it to expire.
+func (n *Node) resign() error {
+	if atomic.SwapInt64(&n.leaseDeadline, 0) == 0 {
+		return nil
+	}
+	leader, index, err := n.backend.GetIndex(leaderKey)
+	if err == ErrKeyNotExist || (err == nil && leader != n.Name) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = n.backend.CompareAndDelete(leaderKey, index)
+	if err == ErrKeyNotExist || err == ErrCompareFailed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package datad
+
+import (
+	"testing"
+	"time"
+)
+
+func waitForLeader(t *testing.T, n *Node) {
+	for i := 0; i < 100; i++ {
+		if n.IsLeader() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("node %s did not become the leader", n.Name)
+}
+
+func TestNode_Campaign(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n1 := NewNode("n1:80", b, NoopProvider{})
+	n2 := NewNode("n2:80", b, NoopProvider{})
+
+	if _, err := c.Leader(); err != ErrKeyNotExist {
+		t.Errorf("got Leader error %v, want ErrKeyNotExist", err)
+	}
+
+	// The first node to campaign becomes the leader, and remains the leader
+	// when it renews its lease.
+	for i := 0; i < 2; i++ {
+		if leader, err := n1.campaign(); err != nil || !leader {
+			t.Fatalf("n1: got campaign == %v, %v, want true", leader, err)
+		}
+		if leader, err := n2.campaign(); err != nil || leader {
+			t.Fatalf("n2: got campaign == %v, %v, want false", leader, err)
+		}
+	}
+	if leader, err := c.Leader(); err != nil || leader != n1.Name {
+		t.Errorf("got Leader == %q, %v, want %q", leader, err, n1.Name)
+	}
+
+	// When the leader resigns (or its lease expires), another node takes
+	// over.
+	must(t, n1.resign())
+	if leader, err := n2.campaign(); err != nil || !leader {
+		t.Fatalf("n2: got campaign == %v, %v, want true after n1 resigned", leader, err)
+	}
+	if leader, err := n1.campaign(); err != nil || leader {
+		t.Fatalf("n1: got campaign == %v, %v, want false after n1 resigned", leader, err)
+	}
+}
+
+// Test that a node stops considering itself the leader when its lease
+// expires, even if it hasn't tried to renew it.
+func TestNode_IsLeader_LeaseExpired(t *testing.T) {
+	defer func(ttl time.Duration) { LeaderLeaseTTL = ttl }(LeaderLeaseTTL)
+	LeaderLeaseTTL = time.Second
+
+	n := NewNode("n1:80", NewMemoryBackend(), NoopProvider{})
+	if leader, err := n.campaign(); err != nil || !leader {
+		t.Fatalf("got campaign == %v, %v, want true", leader, err)
+	}
+	if !n.IsLeader() {
+		t.Fatal("got IsLeader == false after acquiring the lease, want true")
+	}
+	time.Sleep(LeaderLeaseTTL)
+	if n.IsLeader() {
+		t.Error("got IsLeader == true after the lease expired, want false")
+	}
+}
+
+// Test that only one of several nodes becomes the leader, and that another
+// node takes over when the leader stops.
+func TestNode_CampaignPeriodically(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+
+	var nodes []*Node
+	for _, name := range []string{"n1:80", "n2:80", "n3:80"} {
+		n := NewNode(name, b, NoopProvider{})
+		go n.campaignPeriodically()
+		defer n.Stop()
+		nodes = append(nodes, n)
+	}
+
+	leaders := func() (leaders []*Node) {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				leaders = append(leaders, n)
+			}
+		}
+		return leaders
+	}
+	time.Sleep(50 * time.Millisecond)
+	l := leaders()
+	if len(l) != 1 {
+		t.Fatalf("got %d leaders, want 1", len(l))
+	}
+	if leader, err := c.Leader(); err != nil || leader != l[0].Name {
+		t.Errorf("got Leader == %q, %v, want %q", leader, err, l[0].Name)
+	}
+
+	// Stopping the leader makes it resign, so the next campaign elects
+	// another node.
+	l[0].Stop()
+	time.Sleep(50 * time.Millisecond)
+	for _, n := range nodes {
+		if n != l[0] {
+			if _, err := n.campaign(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if leader, err := c.Leader(); err != nil || leader == l[0].Name {
+		t.Errorf("got Leader == %q, %v, want a node other than the stopped leader %q", leader, err, l[0].Name)
+	}
+}
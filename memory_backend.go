@@ -0,0 +1,571 @@
+package datad
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryWatchHistory is the number of recent changes that a MemoryBackend
+// remembers so that watchers can resume from an earlier index.
+const memoryWatchHistory = 1000
+
+var (
+	errNotDir  = errors.New("not a directory")
+	errNotFile = errors.New("not a file")
+
+	errDeleteRoot = errors.New("cannot delete the root directory")
+)
+
+// A MemoryBackend is a Backend that stores all keys in memory. It supports
+// directory TTLs and watches, so it can stand in for etcd in tests and in
+// single-process deployments. It is safe for concurrent use.
+type MemoryBackend struct {
+	mu    sync.Mutex
+	root  *memNode
+	index uint64
+
+	// history holds the most recent changes, oldest first.
+	history []*WatchEvent
+
+	// changed is closed (and replaced) whenever a change is made.
+	changed chan struct{}
+
+	// persist, if set, is called with each change (or, for a transaction,
+	// with all of its changes at once) so that it can be saved elsewhere.
+	persist func(changes []memChange) error
+
+	// batch, if set, collects changes to persist at the end of a transaction
+	// instead of persisting them one at a time.
+	batch *[]memChange
+}
+
+// A memChange is a change to persist, along with the changed key's
+// expiration.
+type memChange struct {
+	ev         *WatchEvent
+	expiration time.Time
+}
+
+type memNode struct {
+	name     string
+	value    string
+	dir      bool
+	children map[string]*memNode
+	parent   *memNode
+	index    uint64
+
+	expiration time.Time // zero if no TTL
+	timer      *time.Timer
+	removed    bool
+}
+
+// NewMemoryBackend creates a new, empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		root:    &memNode{dir: true, children: map[string]*memNode{}},
+		changed: make(chan struct{}),
+	}
+}
+
+func (b *MemoryBackend) Get(key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.lookup(key)
+	if n == nil {
+		return "", ErrKeyNotExist
+	}
+	return n.value, nil
+}
+
+func (b *MemoryBackend) GetIndex(key string) (string, uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.lookup(key)
+	if n == nil {
+		return "", 0, ErrKeyNotExist
+	}
+	return n.value, n.index, nil
+}
+
+func (b *MemoryBackend) Index() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.index, nil
+}
+
+func (b *MemoryBackend) ListKeys(key string, recursive bool) ([]string, error) {
+	return b.listNames(key, recursive, true)
+}
+
+func (b *MemoryBackend) List(key string, recursive bool) ([]string, error) {
+	return b.listNames(key, recursive, false)
+}
+
+func (b *MemoryBackend) listNames(key string, recursive, keysOnly bool) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.lookup(key)
+	if n == nil || !n.dir {
+		return nil, nil
+	}
+
+	var names []string
+	var add func(n *memNode, prefix string)
+	add = func(n *memNode, prefix string) {
+		for _, child := range b.sortedChildren(n) {
+			if !keysOnly || !child.dir {
+				names = append(names, prefix+child.name)
+			}
+			if recursive && child.dir {
+				add(child, prefix+child.name+"/")
+			}
+		}
+	}
+	add(n, "")
+	return names, nil
+}
+
+func (b *MemoryBackend) Set(key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, created, err := b.create(key, false)
+	if err != nil {
+		return err
+	}
+	if !created && n.dir {
+		return errNotFile
+	}
+	n.value = value
+	b.setTTL(n, 0)
+	return b.record(WatchSet, n)
+}
+
+func (b *MemoryBackend) SetDir(key string, ttl uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, created, err := b.create(key, true)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return ErrKeyExists
+	}
+	b.setTTL(n, ttl)
+	return b.record(WatchSet, n)
+}
+
+func (b *MemoryBackend) UpdateDir(key string, ttl uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.lookup(key)
+	if n == nil {
+		return ErrKeyNotExist
+	}
+	if !n.dir {
+		return errNotDir
+	}
+	b.setTTL(n, ttl)
+	return b.record(WatchUpdate, n)
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.lookup(key)
+	if n == nil {
+		return ErrKeyNotExist
+	}
+	if n.dir {
+		return errNotFile
+	}
+	b.remove(n)
+	return b.record(WatchDelete, n)
+}
+
+func (b *MemoryBackend) DeleteDir(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.lookup(key)
+	if n == nil {
+		return ErrKeyNotExist
+	}
+	if !n.dir {
+		return errNotDir
+	}
+	if n == b.root {
+		return errDeleteRoot
+	}
+	b.remove(n)
+	return b.record(WatchDelete, n)
+}
+
+func (b *MemoryBackend) Create(key, value string, ttl uint64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, created, err := b.create(key, false)
+	if err != nil {
+		return 0, err
+	}
+	if !created {
+		return 0, ErrKeyExists
+	}
+	n.value = value
+	b.setTTL(n, ttl)
+	err = b.record(WatchSet, n)
+	return n.index, err
+}
+
+func (b *MemoryBackend) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.lookupForCompare(key, prevIndex)
+	if err != nil {
+		return 0, err
+	}
+	n.value = value
+	b.setTTL(n, ttl)
+	err = b.record(WatchUpdate, n)
+	return n.index, err
+}
+
+func (b *MemoryBackend) CompareAndDelete(key string, prevIndex uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.lookupForCompare(key, prevIndex)
+	if err != nil {
+		return err
+	}
+	b.remove(n)
+	return b.record(WatchDelete, n)
+}
+
+// Txn implements TxnBackend. All ops are checked before any are applied, and
+// their changes are persisted together.
+func (b *MemoryBackend) Txn(ops []TxnOp) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, op := range ops {
+		if err := b.checkTxnOp(op); err != nil {
+			return err
+		}
+	}
+
+	var batch []memChange
+	b.batch = &batch
+	for _, op := range ops {
+		switch op.Type {
+		case TxnCreate, TxnSet:
+			n, _, _ := b.create(op.Key, false)
+			n.value = op.Value
+			b.setTTL(n, 0)
+			b.record(WatchSet, n)
+		case TxnDelete, TxnCompareAndDelete:
+			n := b.lookup(op.Key)
+			b.remove(n)
+			b.record(WatchDelete, n)
+		}
+	}
+	b.batch = nil
+
+	if b.persist != nil && len(batch) > 0 {
+		return b.persist(batch)
+	}
+	return nil
+}
+
+// checkTxnOp returns the error that applying op would return, without
+// applying it. The caller must hold b.mu.
+func (b *MemoryBackend) checkTxnOp(op TxnOp) error {
+	switch op.Type {
+	case TxnCreate, TxnSet:
+		n := b.root
+		for _, name := range splitKey(op.Key) {
+			if !n.dir {
+				return errNotDir
+			}
+			if n = n.children[name]; n == nil || b.expireIfElapsed(n) {
+				return nil
+			}
+		}
+		if op.Type == TxnCreate {
+			return ErrKeyExists
+		}
+		if n.dir {
+			return errNotFile
+		}
+		return nil
+	case TxnDelete:
+		n := b.lookup(op.Key)
+		if n == nil {
+			return ErrKeyNotExist
+		}
+		if n.dir {
+			return errNotFile
+		}
+		return nil
+	case TxnCompareAndDelete:
+		_, err := b.lookupForCompare(op.Key, op.PrevIndex)
+		return err
+	}
+	return fmt.Errorf("unknown transaction op type %d", op.Type)
+}
+
+// lookupForCompare returns the node at key if its modification index is
+// prevIndex. The caller must hold b.mu.
+func (b *MemoryBackend) lookupForCompare(key string, prevIndex uint64) (*memNode, error) {
+	n := b.lookup(key)
+	if n == nil {
+		return nil, ErrKeyNotExist
+	}
+	if n.dir {
+		return nil, errNotFile
+	}
+	if n.index != prevIndex {
+		return nil, ErrCompareFailed
+	}
+	return n, nil
+}
+
+// Watch sends each change to key (and, if recursive, to keys beneath it) on
+// events until stop is closed. If waitIndex is nonzero, changes starting at
+// that index are sent, which lets callers resume an earlier watch; otherwise
+// only changes made after Watch is called are sent. Watch closes events
+// before returning.
+func (b *MemoryBackend) Watch(key string, waitIndex uint64, recursive bool, events chan<- *WatchEvent, stop <-chan struct{}) error {
+	defer close(events)
+
+	key = keyPathJoin(key)
+
+	b.mu.Lock()
+	next := waitIndex
+	if next == 0 {
+		next = b.index + 1
+	}
+	b.mu.Unlock()
+
+	for {
+		b.mu.Lock()
+		if len(b.history) > 0 && next < b.history[0].Index {
+			b.mu.Unlock()
+			return ErrWatchIndexCleared
+		}
+		var evs []*WatchEvent
+		for _, ev := range b.history {
+			if ev.Index >= next && watchMatches(key, ev.Key, recursive) {
+				evs = append(evs, ev)
+			}
+		}
+		next = b.index + 1
+		changed := b.changed
+		b.mu.Unlock()
+
+		for _, ev := range evs {
+			ev2 := *ev
+			select {
+			case events <- &ev2:
+			case <-stop:
+				return nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func watchMatches(watchKey, key string, recursive bool) bool {
+	if key == watchKey {
+		return true
+	}
+	return recursive && strings.HasPrefix(key, trailingSlash(watchKey))
+}
+
+// lookup returns the node at key, or nil if there is none. The caller must
+// hold b.mu.
+func (b *MemoryBackend) lookup(key string) *memNode {
+	n := b.root
+	for _, name := range splitKey(key) {
+		if !n.dir {
+			return nil
+		}
+		n = n.children[name]
+		if n == nil || b.expireIfElapsed(n) {
+			return nil
+		}
+	}
+	return n
+}
+
+// create returns the node at key, creating it and any missing parent
+// directories if needed. The caller must hold b.mu.
+func (b *MemoryBackend) create(key string, dir bool) (n *memNode, created bool, err error) {
+	n = b.root
+	names := splitKey(key)
+	for i, name := range names {
+		if !n.dir {
+			return nil, false, errNotDir
+		}
+		child := n.children[name]
+		if child != nil && b.expireIfElapsed(child) {
+			child = nil
+		}
+		if child == nil {
+			child = &memNode{name: name, parent: n, dir: dir || i < len(names)-1}
+			if child.dir {
+				child.children = map[string]*memNode{}
+			}
+			n.children[name] = child
+			created = true
+			if i < len(names)-1 {
+				if err := b.record(WatchSet, child); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+		n = child
+	}
+	return n, created, nil
+}
+
+// remove detaches n (and its subtree) from the tree. The caller must hold
+// b.mu.
+func (b *MemoryBackend) remove(n *memNode) {
+	if n.parent != nil {
+		delete(n.parent.children, n.name)
+	}
+	var mark func(n *memNode)
+	mark = func(n *memNode) {
+		n.removed = true
+		if n.timer != nil {
+			n.timer.Stop()
+		}
+		for _, child := range n.children {
+			mark(child)
+		}
+	}
+	mark(n)
+}
+
+// setTTL sets n's expiration to ttl seconds from now, or removes n's
+// expiration if ttl is 0. The caller must hold b.mu.
+func (b *MemoryBackend) setTTL(n *memNode, ttl uint64) {
+	var exp time.Time
+	if ttl != 0 {
+		exp = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	b.setExpiration(n, exp)
+}
+
+// setExpiration sets the time at which n expires, or removes n's expiration
+// if exp is zero. The caller must hold b.mu.
+func (b *MemoryBackend) setExpiration(n *memNode, exp time.Time) {
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	n.expiration = exp
+	if exp.IsZero() {
+		return
+	}
+
+	n.timer = time.AfterFunc(exp.Sub(time.Now()), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if !n.removed && n.expiration.Equal(exp) {
+			b.expireIfElapsed(n)
+		}
+	})
+}
+
+// expireIfElapsed removes n if its TTL has elapsed and reports whether it
+// did so. The caller must hold b.mu.
+func (b *MemoryBackend) expireIfElapsed(n *memNode) bool {
+	if n.expiration.IsZero() || time.Now().Before(n.expiration) {
+		return false
+	}
+	b.remove(n)
+	// Errors persisting expirations are ignored, because the expiration time
+	// itself was persisted and expired keys are discarded when loaded.
+	b.record(WatchExpire, n)
+	return true
+}
+
+// record increments the modification index, notifies watchers of a change
+// to n, and persists the change if needed. The caller must hold b.mu.
+func (b *MemoryBackend) record(action WatchAction, n *memNode) error {
+	b.index++
+	n.index = b.index
+
+	ev := &WatchEvent{Action: action, Key: n.key(), Dir: n.dir, Index: b.index}
+	if action == WatchSet || action == WatchUpdate {
+		ev.Value = n.value
+	}
+	b.history = append(b.history, ev)
+	if len(b.history) > memoryWatchHistory {
+		b.history = b.history[len(b.history)-memoryWatchHistory:]
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	if b.persist == nil {
+		return nil
+	}
+	c := memChange{ev, n.expiration}
+	if b.batch != nil {
+		*b.batch = append(*b.batch, c)
+		return nil
+	}
+	return b.persist([]memChange{c})
+}
+
+func (b *MemoryBackend) sortedChildren(n *memNode) []*memNode {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := make([]*memNode, 0, len(names))
+	for _, name := range names {
+		if child := n.children[name]; !b.expireIfElapsed(child) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// key returns the full key of n, with a leading slash.
+func (n *memNode) key() string {
+	var names []string
+	for ; n != nil && n.parent != nil; n = n.parent {
+		names = append(names, n.name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return keyPathJoin(names...)
+}
+
+// splitKey splits key into its slash-separated components, ignoring empty
+// components.
+func splitKey(key string) []string {
+	return strings.FieldsFunc(key, func(c rune) bool { return c == '/' })
+}
@@ -0,0 +1,60 @@
+package datad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	b := NewMemoryBackend()
+	testBackend(t, b)
+	testBackendWatch(t, b)
+	testBackendCompareAndSwap(t, b)
+	testBackendTxn(t, b)
+}
+
+func TestMemoryBackend_DirTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("requires at least 1s sleep")
+	}
+
+	testBackendDirTTL(t, NewMemoryBackend(), 1)
+}
+
+func TestMemoryBackend_Watch(t *testing.T) {
+	b := NewMemoryBackend()
+
+	must(t, b.Set("other", "x"))
+	must(t, b.Set("dir/a", "1"))
+
+	events := make(chan *WatchEvent)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- b.Watch("dir", 2, true, events, stop) }()
+
+	must(t, b.Set("dir/b", "2"))
+	must(t, b.Delete("dir/a"))
+	must(t, b.Set("other", "y"))
+
+	var got []WatchEvent
+	for i := 0; i < 4; i++ {
+		got = append(got, *<-events)
+	}
+	want := []WatchEvent{
+		{Action: WatchSet, Key: "/dir", Dir: true, Index: 2},
+		{Action: WatchSet, Key: "/dir/a", Value: "1", Index: 3},
+		{Action: WatchSet, Key: "/dir/b", Value: "2", Index: 4},
+		{Action: WatchDelete, Key: "/dir/a", Index: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %+v, want %+v", got, want)
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-events; ok {
+		t.Error("events channel not closed after Watch returned")
+	}
+}
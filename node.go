@@ -1,6 +1,8 @@
 package datad
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,8 +12,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/coreos/go-etcd/etcd"
 )
 
 var (
@@ -36,12 +36,105 @@ type Node struct {
 	updateQ   chan string
 	updateQMu sync.Mutex
 
+	// Replication determines the number of nodes that the balancer ensures
+	// each key is registered to. All nodes and clients in a cluster should
+	// use the same policy.
+	Replication ReplicationPolicy
+
+	// Placement decides which nodes the balancer registers keys to. If nil,
+	// RendezvousPlacement is used.
+	Placement Placement
+
+	// Labels describe this node (e.g., {"zone": "us-east-1a"}) to clients,
+	// which may prefer nodes with certain labels (see LocalitySelector).
+	// They are published in this node's NodeInfo.
+	Labels map[string]string
+
+	// CapacityWatermark is the fraction (between 0 and 1) of the provider's
+	// storage capacity above which this node stops accepting new keys. It
+	// only applies if the provider implements CapacityProvider. If 0,
+	// DefaultCapacityWatermark is used.
+	CapacityWatermark float64
+
+	// EvictionGracePeriod is how long after a key is deregistered from this
+	// node that the node removes its data for the key (if the provider
+	// implements KeyRemover and the key has not been registered to this node
+	// again). If 0, DefaultEvictionGracePeriod is used.
+	EvictionGracePeriod time.Duration
+
+	// evictionsMu synchronizes access to evictions, the timers (by key) of
+	// the scheduled removals of deregistered keys' data.
+	evictionsMu sync.Mutex
+	evictions   map[string]*time.Timer
+
+	// MaxBytes is the maximum size, in bytes, of this node's data. When the
+	// data exceeds it, the node evicts the least recently used keys until
+	// the data fits (see EvictionInterval). It only applies if the provider
+	// implements KeyStater and KeyRemover. While the data still exceeds it
+	// after eviction, the node doesn't accept new keys. If 0, keys are not
+	// evicted to free space.
+	MaxBytes uint64
+
+	// EvictionCooldown is how long after this node evicts a key to keep its
+	// data within MaxBytes that the key is not registered to this node again
+	// (see NodeInfo.EvictedKeys). Otherwise, the balancer might register a
+	// key that still needs more replicas to this node again, only for this
+	// node to evict it again. If 0, DefaultEvictionCooldown is used.
+	EvictionCooldown time.Duration
+
+	// evictedMu synchronizes access to evicted, the times (by key) that this
+	// node evicted keys to keep its data within MaxBytes.
+	evictedMu sync.Mutex
+	evicted   map[string]time.Time
+
+	// accessMu synchronizes access to accessed, the times (by key) that
+	// keys' data on this node was last accessed (as recorded by
+	// RecordAccess or by updates).
+	accessMu sync.Mutex
+	accessed map[string]time.Time
+
+	// MoveBudget is the maximum number of keys that this node, when it is
+	// the balancer leader, moves between nodes at a time (to balance their
+	// load) without overloading the origin servers that the keys are
+	// fetched from. If 0, DefaultMoveBudget is used; if negative, no keys
+	// are moved.
+	MoveBudget int
+
+	// infoMu synchronizes access to refuseKeys (set by SetAccepting),
+	// draining (set by Drain), overMaxBytes (whether the node's data
+	// exceeded MaxBytes after the last eviction), and infoPublished (the
+	// time of the last publishInfo).
+	infoMu        sync.Mutex
+	refuseKeys    bool
+	draining      bool
+	overMaxBytes  bool
+	infoPublished time.Time
+
+	// leaseDeadline is when this node's balancer leader lease expires (in
+	// Unix nanoseconds), or 0 if this node does not hold the lease (see
+	// IsLeader). It is accessed atomically.
+	leaseDeadline int64
+
+	// joined is whether this node has joined the cluster. It is only
+	// accessed by refreshClusterMembership.
+	joined bool
+
+	// membership tracks the goroutine that refreshes this node's cluster
+	// membership (see joinCluster).
+	membership sync.WaitGroup
+
 	backend  Backend
 	registry *Registry
 
 	Log *log.Logger
 
 	stopChan chan struct{}
+	stopOnce sync.Once
+
+	// ctx is canceled when this node is stopped, which cancels in-flight
+	// updates.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewNode creates a new node to publish data from a provider to the cluster.
@@ -52,6 +145,7 @@ type Node struct {
 // Call Start on this node to begin publishing its keys to the cluster.
 func NewNode(name string, b Backend, p Provider) *Node {
 	name = cleanNodeName(name)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Node{
 		Name:     name,
 		Provider: p,
@@ -61,6 +155,8 @@ func NewNode(name string, b Backend, p Provider) *Node {
 		registry: NewRegistry(b),
 		Log:      log.New(os.Stderr, "", log.Ltime|log.Lmicroseconds|log.Lshortfile),
 		stopChan: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
@@ -93,22 +189,184 @@ func (n *Node) Start() error {
 		if err != nil {
 			n.logf("Failed to register existing keys: %s", err)
 		}
+		if err := n.prefetchPinned(); err != nil {
+			n.logf("Failed to prefetch pinned keys: %s", err)
+		}
 	}()
 
 	go n.watchRegisteredKeys()
+	go n.watchMembership()
+	go n.campaignPeriodically()
+	go n.evictPeriodically()
 	go n.balancePeriodically()
 	go n.startUpdater()
 
 	return nil
 }
 
-// Stop deregisters this node's keys and stops background processes
-// for this node.
+// Stop stops background processes for this node, and cancels the provider's
+// in-flight updates (if it is a ContextProvider). It does not deregister the
+// node's keys, and the node remains a member of the cluster until its
+// membership expires (after NodeMembershipTTL); use Drain to hand off the
+// node's keys and leave the cluster first. Stop may be called more than once.
 func (n *Node) Stop() error {
-	close(n.stopChan)
+	n.stopOnce.Do(func() {
+		close(n.stopChan)
+		n.cancel()
+	})
 	return nil
 }
 
+// drainPollInterval is how often Drain checks whether the nodes that it
+// handed keys off to have fetched them.
+var drainPollInterval = time.Second
+
+// Drain gracefully removes this node from the cluster. It stops accepting new
+// keys, registers each of this node's keys to other nodes (so that each key
+// has as many replicas as n.Replication requires without this node), waits
+// until another node has each key's data, and deregisters each key from this
+// node. Finally, it stops this node and leaves the cluster.
+//
+// Keys that no other node manages to fetch are deregistered from this node
+// anyway (after the other nodes report that they failed), because this node
+// is about to leave. A key is never deregistered from this node while no
+// other node is registered to it, though. If ctx is done before all keys are
+// handed off (or if Drain fails), Drain returns the error, and this node
+// remains a member of the cluster with the keys that were not handed off yet
+// and accepts new keys again (unless SetAccepting(false) was called), so
+// that Drain may be called again.
+func (n *Node) Drain(ctx context.Context) (err error) {
+	n.infoMu.Lock()
+	n.draining = true
+	n.infoMu.Unlock()
+	defer func() {
+		if err != nil {
+			n.infoMu.Lock()
+			n.draining = false
+			n.infoMu.Unlock()
+			if err := n.publishInfoIfMember(); err != nil {
+				n.logf("Error publishing node %s info: %s.", n.Name, err)
+			}
+		}
+	}()
+	if err := n.publishInfoIfMember(); err != nil {
+		return err
+	}
+
+	c := n.client()
+	clusterNodes, err := c.NodesInCluster()
+	if err != nil {
+		return err
+	}
+	others, err := c.acceptingNodes(clusterNodes)
+	if err != nil {
+		return err
+	}
+	for i, node := range others {
+		if node == n.Name {
+			others = append(others[:i], others[i+1:]...)
+			break
+		}
+	}
+
+	keys, err := n.registry.KeysForNode(n.Name)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 && len(others) == 0 {
+		return ErrNoAvailableNodesForRegistration
+	}
+
+	pinned, err := n.registry.pinnedSet()
+	if err != nil {
+		return err
+	}
+
+	n.logf("Draining: handing off %d keys to other nodes.", len(keys))
+	// handOff registers key to other nodes. (If another caller is
+	// registering key concurrently, AddReplicas returns the nodes that it
+	// chose, which might not be registered yet.)
+	handOff := func(key string) error {
+		// This node is still registered, so it counts as one of the replicas.
+		replicas := c.Replication.replicas(key, pinned[keyPathJoin(key)]) + 1
+		_, err := n.registry.AddReplicas(key, c.placement().Nodes(key, others), replicas)
+		return err
+	}
+	pending := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if err := handOff(key); err != nil {
+			return err
+		}
+		pending[key] = struct{}{}
+	}
+
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for len(pending) > 0 {
+		for key := range pending {
+			statuses, err := n.registry.Statuses(key)
+			if err != nil {
+				return err
+			}
+			var registered, ready, busy bool
+			for node, status := range statuses {
+				if node != n.Name {
+					registered = true
+					ready = ready || status.Ready()
+					busy = busy || status.Busy()
+				}
+			}
+			if !registered {
+				// The key isn't registered to any other node yet, so
+				// deregistering it would leave it with no replicas.
+				if err := handOff(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if !ready && busy {
+				continue
+			}
+			if !ready {
+				n.logf("Draining: no other node fetched key %q; deregistering it anyway.", key)
+			}
+
+			err = n.registry.Remove(key, n.Name)
+			if err == ErrCompareFailed {
+				// The registration was concurrently modified (e.g., an update
+				// was requested), so try again later.
+				continue
+			} else if err != nil && err != ErrKeyNotExist {
+				return err
+			}
+			delete(pending, key)
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		n.logf("Draining: waiting for other nodes to fetch %d keys.", len(pending))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	n.logf("Draining: handed off all keys; leaving the cluster.")
+	n.Stop()
+
+	// Wait for a membership refresh that is in progress, so that it doesn't
+	// re-create the membership after it's deleted.
+	n.membership.Wait()
+
+	err = n.backend.DeleteDir(keyPathJoin(nodesPrefix, n.Name))
+	if err == ErrKeyNotExist {
+		err = nil
+	}
+	return err
+}
+
 // joinCluster adds this node's provider to the cluster, making it available to
 // receive requests for and be assigned keys. It then periodically re-adds this
 // node to the cluster before the TTL on the etcd cluster membership key
@@ -123,7 +381,9 @@ func (n *Node) joinCluster() error {
 		panic("NodeMembershipTTL must be at least 2 seconds")
 	}
 
+	n.membership.Add(1)
 	go func() {
+		defer n.membership.Done()
 		t := time.NewTicker(NodeMembershipTTL - 800*time.Millisecond)
 		for {
 			select {
@@ -144,77 +404,203 @@ func (n *Node) joinCluster() error {
 
 func (n *Node) refreshClusterMembership() error {
 	err := n.backend.SetDir(keyPathJoin(nodesPrefix, n.Name), uint64(NodeMembershipTTL/time.Second))
-	if isEtcdErrorCode(err, 102) {
+	if err == ErrKeyExists {
 		err = n.backend.UpdateDir(keyPathJoin(nodesPrefix, n.Name), uint64(NodeMembershipTTL/time.Second))
+	} else if err == nil && n.joined {
+		// This node's membership expired (e.g., because the backend was
+		// unreachable), so balancers might have deregistered its keys.
+		n.logf("Node %s rejoined the cluster after its membership expired; registering existing keys again.", n.Name)
+
+		// Its info expired along with its membership, so publish it again
+		// now (below), so that it isn't assumed to accept keys.
+		n.infoMu.Lock()
+		n.infoPublished = time.Time{}
+		n.infoMu.Unlock()
+
+		go func() {
+			if err := n.registerExistingKeys(); err != nil {
+				n.logf("Failed to register existing keys: %s", err)
+			}
+		}()
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	n.joined = true
+
+	// Publish this node's info now that its membership directory (which
+	// holds the info) is known to exist.
+	n.infoMu.Lock()
+	publish := time.Since(n.infoPublished) >= NodeInfoInterval
+	n.infoMu.Unlock()
+	if publish {
+		if err := n.publishInfo(); err != nil {
+			n.logf("Error publishing node %s info: %s.", n.Name, err)
+		}
+	}
+	return nil
 }
 
 // watchRegisteredKeys watches the registry for changes to the list of keys that
 // this node is registered for, or for modifications of existing registrations
-// (e.g., updates requested).
+// (e.g., updates requested). If the watch fails, it is resumed from the last
+// change seen.
 func (n *Node) watchRegisteredKeys() error {
 	watchKey := keysForNodeDir(n.Name)
-	fullKey := n.backend.(*EtcdBackend).fullKey(watchKey)
+	return n.watch("registry", watchKey, func(ev *WatchEvent) {
+		if ev.Dir {
+			return
+		}
+		key := strings.TrimPrefix(ev.Key, watchKey+"/")
+		n.logf("Registry changed: %s on key %q.", ev.Action, key)
+		if ev.Action == WatchDelete || ev.Action == WatchExpire {
+			n.scheduleEviction(key)
+			return
+		}
+		n.cancelEviction(key)
+		if RegistrationReason(ev.Value) == ReasonExisting {
+			// This node registered the key because it already has the
+			// key's data, so there's nothing to fetch.
+			return
+		}
+		n.logf("Queueing update for key %q in data source (in response to registry %s).", key, ev.Action)
+		select {
+		case n.updateQ <- key:
+		case <-n.stopChan:
+		}
+	})
+}
 
-	recv := make(chan *etcd.Response, 10)
-	stopWatch := make(chan bool, 1)
+// watch calls handle with each change to key (and keys beneath it) until
+// this node is stopped. If the watch fails, it is resumed from the last
+// change seen. The name describes the watcher in log messages.
+func (n *Node) watch(name, key string, handle func(ev *WatchEvent)) error {
+	var waitIndex uint64
+	for {
+		events := make(chan *WatchEvent, 10)
+		done := make(chan struct{})
 
-	// Receive watched changes.
-	go func() {
-		for {
-			select {
-			case resp, ok := <-recv:
-				if !ok {
-					return
-				}
-				key := strings.TrimPrefix(resp.Node.Key, fullKey+"/")
-				n.logf("Registry changed: %s on key %q.", resp.Action, key)
-				if !strings.Contains(strings.ToLower(resp.Action), "delete") {
-					n.logf("Queueing update for key %q in data source (in response to registry %s).", key, resp.Action)
-					n.updateQ <- key
-				}
-			case <-n.stopChan:
-				n.logf("Stopping registry watcher.")
-				stopWatch <- true
-				return
+		// Receive watched changes.
+		go func() {
+			defer close(done)
+			for ev := range events {
+				waitIndex = ev.Index + 1
+				handle(ev)
 			}
+		}()
+
+		err := n.backend.Watch(key, waitIndex, true, events, n.stopChan)
+		<-done
+
+		select {
+		case <-n.stopChan:
+			n.logf("Stopping %s watcher.", name)
+			return nil
+		default:
 		}
-	}()
 
-	_, err := n.backend.(*EtcdBackend).etcd.Watch(fullKey, 0, true, recv, stopWatch)
-	if err != etcd.ErrWatchStoppedByUser {
-		return err
+		if err == ErrWatchIndexCleared {
+			// Changes were missed; there is no way to recover them, so just
+			// resume with the latest changes.
+			waitIndex = 0
+		}
+		n.logf("The %s watcher failed: %v. Resuming watch in 1s.", name, err)
+		select {
+		case <-time.After(time.Second):
+		case <-n.stopChan:
+			return nil
+		}
 	}
-	return nil
 }
 
+// registrationProgressInterval is how often registerExistingKeys logs its
+// progress.
+var registrationProgressInterval = 10 * time.Second
+
+// errNodeStopped is returned by fn callbacks to stop walking the provider's
+// keys when the node is stopped.
+var errNodeStopped = errors.New("node stopped")
+
 // registerExistingKeys examines this node's provider's local storage for data
 // and registers each data key it finds. This means that when the node starts
 // up, it's immediately able to receive requests for the data it already has on
 // disk. Without this, the cluster would not know that this node's provider has
 // these keys.
+//
+// If the provider is a KeyWalker, keys are registered (in batches) as they
+// are found, so that the node can serve them before all of its keys are found.
 func (n *Node) registerExistingKeys() error {
 	n.logf("Finding existing keys to register... (this may take a while)")
 
-	keys, err := n.Provider.Keys("")
+	registeredKeys, err := n.registry.KeysForNode(n.Name)
 	if err != nil {
 		return err
 	}
+	registered := make(map[string]bool, len(registeredKeys))
+	for _, key := range registeredKeys {
+		registered[keyPathJoin(key)] = true
+	}
 
-	if len(keys) == 0 {
+	ready := RegistrationStatus{State: StateReady}
+	var batch []string
+	var found, added int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := n.registry.AddKeys(n.Name, batch, ready, ReasonExisting); err != nil {
+			return err
+		}
+		added += len(batch)
+		batch = batch[:0]
 		return nil
 	}
 
-	n.logf("Found %d existing keys in provider: %v. Registering existing keys to this node...", len(keys), keys)
-	for _, key := range keys {
-		err := n.registry.Add(key, n.Name)
-		if err != nil {
-			return err
+	start, lastProgress := time.Now(), time.Now()
+	err = walkKeys(n.Provider, "", func(key string) error {
+		select {
+		case <-n.stopChan:
+			return errNodeStopped
+		default:
+		}
+
+		found++
+		if registered[keyPathJoin(key)] {
+			// The key was registered before this node (re)started. Its data
+			// is on disk, so mark it ready if it isn't already.
+			status, err := n.registry.Status(key, n.Name)
+			if err == nil && !status.Ready() {
+				err = n.registry.SetStatus(key, n.Name, ready)
+			}
+			if err != nil && err != ErrKeyNotExist {
+				return err
+			}
+		} else {
+			batch = append(batch, key)
+			if len(batch) >= registryBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+
+		if time.Since(lastProgress) >= registrationProgressInterval {
+			n.logf("Found %d existing keys so far (%s elapsed); registered %d new keys to this node.", found, time.Since(start), added)
+			lastProgress = time.Now()
 		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == errNodeStopped {
+		n.logf("Stopped registering existing keys (node stopped) after finding %d keys.", found)
+		return nil
+	} else if err != nil {
+		return err
 	}
-	n.logf("Finished registering existing %d keys to this node.", len(keys))
 
+	n.logf("Finished registering existing keys to this node: found %d keys (%d newly registered) in %s.", found, added, time.Since(start))
 	return nil
 }
 
@@ -267,7 +653,7 @@ func (n *Node) startUpdater() {
 				select {
 				case key := <-keyToUpdate:
 					status <- keyStatus{key, false}
-					err := n.Provider.Update(key)
+					err := n.update(key)
 					if err == nil {
 						n.logf("Update succeeded for key %q.", key)
 					} else {
@@ -282,6 +668,51 @@ func (n *Node) startUpdater() {
 	}
 }
 
+// update updates key from the provider's data source, recording the
+// update's progress in the status of key's registration to this node (if
+// key is registered to this node).
+func (n *Node) update(key string) error {
+	prev, err := n.registry.Status(key, n.Name)
+	registered := err == nil
+	if err != nil && err != ErrKeyNotExist {
+		n.logf("Failed to get registration status of key %q: %s.", key, err)
+	}
+
+	if registered && !prev.Ready() {
+		n.setStatus(key, RegistrationStatus{State: StateFetching})
+	}
+
+	err = NewContextProvider(n.Provider).UpdateContext(n.ctx, key)
+	if err == nil {
+		n.RecordAccess(key)
+	}
+
+	if err != nil && n.ctx.Err() != nil {
+		// The update was canceled because this node is stopping, which
+		// says nothing about whether it could fetch the key, so leave the
+		// key's status as it is (instead of marking it failed).
+		return err
+	}
+	if registered {
+		status := RegistrationStatus{State: StateReady}
+		if err != nil {
+			status.Error = err.Error()
+			if !prev.Ready() {
+				status.State = StateFailed
+			}
+		}
+		n.setStatus(key, status)
+	}
+	return err
+}
+
+func (n *Node) setStatus(key string, status RegistrationStatus) {
+	err := n.registry.SetStatus(key, n.Name, status)
+	if err != nil && err != ErrKeyNotExist {
+		n.logf("Failed to set registration status of key %q to %s: %s.", key, status.State, err)
+	}
+}
+
 // startBalancer starts a periodic process that balances the distribution of
 // keys to nodes.
 func (n *Node) balancePeriodically() {
@@ -301,21 +732,66 @@ func (n *Node) balancePeriodically() {
 	}
 }
 
-// balance examines all keys and ensures each key has a registered node. If not,
-// it registers a node for the key. This lets the cluster heal itself after a
-// node goes down (which causes keys to be orphaned).
+// balanceClusterRefreshInterval is how often balance refreshes its list of
+// the cluster's nodes, so that it notices nodes that join, leave, or stop
+// accepting keys during a balance run.
+var balanceClusterRefreshInterval = NodeMembershipTTL
+
+// balance examines all keys and ensures each key is registered to as many
+// nodes as n.Replication requires. If not, it registers more nodes for the
+// key. Keys registered to nodes that are no longer members of the cluster
+// (because their membership expired) are deregistered from those nodes and
+// registered to live nodes instead. This lets the cluster heal itself after a
+// node goes down (which causes keys to be orphaned or under-replicated).
+//
+// Only the balancer leader (see IsLeader) balances the whole keyspace and
+// checks the liveness of keys on other nodes. Other nodes balance only the
+// keys registered to them. The leader also moves keys from overloaded nodes
+// to the least loaded nodes (see rebalanceLoad).
 func (n *Node) balance() error {
 	keyMap, err := n.registry.KeyMap()
 	if err != nil {
 		return err
 	}
 
+	leader := n.IsLeader()
+	if !leader {
+		for key, nodes := range keyMap {
+			if !containsString(nodes, n.Name) {
+				delete(keyMap, key)
+			}
+		}
+	}
+
 	if len(keyMap) == 0 {
 		return nil
 	}
 
-	c := NewClient(n.backend)
-	clusterNodes, err := c.NodesInCluster()
+	c := n.client()
+	var clusterNodes, acceptingNodes []string
+	var isClusterNode map[string]bool
+	var clusterRefreshed time.Time
+	refreshCluster := func() error {
+		var err error
+		clusterNodes, err = c.NodesInCluster()
+		if err != nil {
+			return err
+		}
+		acceptingNodes, err = c.acceptingNodes(clusterNodes)
+		if err != nil {
+			return err
+		}
+		isClusterNode = make(map[string]bool, len(clusterNodes))
+		for _, node := range clusterNodes {
+			isClusterNode[node] = true
+		}
+		clusterRefreshed = time.Now()
+		return nil
+	}
+	if err := refreshCluster(); err != nil {
+		return err
+	}
+	pinned, err := n.registry.pinnedSet()
 	if err != nil {
 		return err
 	}
@@ -324,7 +800,11 @@ func (n *Node) balance() error {
 	x := rand.Intn(10)
 	start := time.Now()
 
-	n.logf("Balancer: starting on %d keys, with known cluster nodes %v.", len(keyMap), clusterNodes)
+	if leader {
+		n.logf("Balancer: starting on %d keys (as leader), with known cluster nodes %v.", len(keyMap), clusterNodes)
+	} else {
+		n.logf("Balancer: starting on %d keys registered to this node, with known cluster nodes %v.", len(keyMap), clusterNodes)
+	}
 	actions := 0
 	iterations := 0
 	for key, nodes := range keyMap {
@@ -338,24 +818,69 @@ func (n *Node) balance() error {
 
 		iterations++
 
-		if len(nodes) == 0 {
-			regNode := clusterNodes[keyBucket(key, len(clusterNodes))]
+		if time.Since(clusterRefreshed) > balanceClusterRefreshInterval {
+			if err := refreshCluster(); err != nil {
+				return err
+			}
+		}
 
-			n.logf("Balancer: found unregistered key %q; registering it to node %s.", key, regNode)
+		// Deregister the key from nodes that have left the cluster. Nodes
+		// that aren't in the (possibly stale) list of cluster nodes are
+		// checked again, since they might have joined since it was fetched.
+		liveNodes := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			if !isClusterNode[node] {
+				member, err := c.isMember(node)
+				if err != nil {
+					return err
+				}
+				if !member {
+					n.logf("Balancer: node %s (registered for key %q) is no longer a member of the cluster; deregistering key from it.", node, key)
+					if err := c.registry.Remove(key, node); err != nil && err != ErrKeyNotExist && err != ErrCompareFailed {
+						return err
+					}
+					actions++
+					continue
+				}
+			}
+			liveNodes = append(liveNodes, node)
+		}
+		nodes = liveNodes
+
+		// Register the key to more nodes if it has too few replicas (and
+		// there are nodes available to hold more).
+		replicas := c.Replication.replicas(key, pinned[keyPathJoin(key)])
+		candidates := c.placement().Nodes(key, acceptingNodes)
+		if len(chooseReplicas(nodes, candidates, replicas)) > 0 {
+			n.logf("Balancer: found key %q registered to %d/%d nodes %v; registering it to more nodes.", key, len(nodes), replicas, nodes)
+
+			// Check the candidates again now, since they might have left
+			// the cluster or stopped accepting keys since the list of
+			// cluster nodes was fetched. Also exclude the nodes that
+			// recently evicted the key.
+			candidates, err = c.acceptingNodesForKey(key, candidates)
+			if err != nil {
+				return err
+			}
 
-			// TODO(sqs): optimize this by only adding if not exists, and then
-			// seeing if it exists (to avoid potentially duplicating work).
-			err := c.registry.Add(key, regNode)
+			regNodes, err := c.registry.AddReplicas(key, candidates, replicas)
 			if err != nil {
 				return err
 			}
+			n.logf("Balancer: key %q is now registered to nodes %v.", key, regNodes)
 
 			actions++
-			continue
+			if len(nodes) == 0 {
+				continue
+			}
 		}
 
-		// Check liveness of key on each node.
+		// Check liveness of key on each node (or only on this node, if this
+		// node is not the leader).
 		for _, node := range nodes {
+			if !leader && node != n.Name {
+				continue
+			}
 			t, err := c.transportForKey(key, nil, []string{node})
 			if err != nil {
 				return err
@@ -366,9 +891,18 @@ func (n *Node) balance() error {
 			if err != nil {
 				actions++
 				n.logf("Balancer: liveness check failed for key %q on node %s: %s. Client deregistered key from node.", key, node, err)
-			}
-			if resp != nil {
+			} else {
 				resp.Body.Close()
+				// The transport returns application failures (which
+				// don't deregister the node) as is, but the key's root
+				// should always be served successfully.
+				if resp.StatusCode < 200 || resp.StatusCode > 399 {
+					actions++
+					n.logf("Balancer: liveness check failed for key %q on node %s: HTTP status %d. Deregistering key from node.", key, node, resp.StatusCode)
+					if err := c.registry.Remove(key, node); err != nil && err != ErrKeyNotExist && err != ErrCompareFailed {
+						return err
+					}
+				}
 			}
 		}
 
@@ -384,11 +918,36 @@ func (n *Node) balance() error {
 			}
 		}
 	}
+
+	// Move keys from overloaded nodes to balance the load, and finish the
+	// moves started in earlier balance runs (by this or an earlier leader).
+	if leader {
+		finished, err := n.finishMoves(c)
+		if err != nil {
+			return err
+		}
+		actions += finished
+
+		moved, err := n.rebalanceLoad(c, keyMap, clusterNodes, acceptingNodes)
+		if err != nil {
+			return err
+		}
+		actions += moved
+	}
+
 	n.logf("Balancer: completed in %s for %d keys (%d non-read actions performed).", time.Since(start), len(keyMap), actions)
 
 	return nil
 }
 
+// client returns a Client that uses this node's backend and configuration.
+func (n *Node) client() *Client {
+	c := NewClient(n.backend)
+	c.Replication = n.Replication
+	c.Placement = n.Placement
+	return c
+}
+
 func (n *Node) logf(format string, a ...interface{}) {
 	if n.Log != nil {
 		n.Log.Printf(fmt.Sprintf("Node %s: ", n.Name)+format, a...)
@@ -0,0 +1,241 @@
+package datad
+
+import (
+	"encoding/json"
+	"time"
+)
+
+var (
+	// NodeInfoInterval is the minimum time interval between publications of
+	// each node's NodeInfo (which are made when the node refreshes its
+	// cluster membership).
+	NodeInfoInterval = time.Minute
+
+	// DefaultCapacityWatermark is the default value of
+	// Node.CapacityWatermark.
+	DefaultCapacityWatermark = 0.9
+)
+
+// nodeInfoFile is stored in each node's cluster membership directory, so
+// that it expires along with the node's membership.
+const nodeInfoFile = "$$info"
+
+// A CapacityProvider is a Provider that can report how much storage space is
+// available for its data. Nodes whose provider implements CapacityProvider
+// stop accepting new keys when their storage is nearly full.
+type CapacityProvider interface {
+	Provider
+
+	// Capacity returns the free and total space, in bytes, of the storage
+	// that holds the provider's data.
+	Capacity() (free, total uint64, err error)
+}
+
+// NodeInfo describes a node's capacity to hold more keys. Each node
+// publishes it periodically alongside its cluster membership.
+type NodeInfo struct {
+	// Accepting is whether new keys may be registered to the node.
+	Accepting bool `json:"accepting"`
+
+	// Draining is whether the node is handing off its keys to other nodes
+	// before leaving the cluster (see Node.Drain).
+	Draining bool `json:"draining,omitempty"`
+
+	// FreeBytes and TotalBytes are the free and total space of the node's
+	// storage, or zero if its provider does not implement CapacityProvider.
+	FreeBytes  uint64 `json:"freeBytes,omitempty"`
+	TotalBytes uint64 `json:"totalBytes,omitempty"`
+
+	// DataBytes is the size of the node's data for the keys registered to
+	// it, or zero if its provider does not implement KeyStater.
+	DataBytes uint64 `json:"dataBytes,omitempty"`
+
+	// RequestRate is the recent rate of requests for the node's data (in
+	// requests per second), or zero if its provider does not implement
+	// LoadProvider.
+	RequestRate float64 `json:"requestRate,omitempty"`
+
+	// EvictedKeys are the keys that the node evicted within the last
+	// Node.EvictionCooldown, which should not be registered to it again yet.
+	EvictedKeys []string `json:"evictedKeys,omitempty"`
+
+	// Labels are the node's labels (see Node.Labels).
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Keys is the number of keys registered to the node.
+	Keys int `json:"keys"`
+
+	// Time is when the node published the info.
+	Time time.Time `json:"time"`
+}
+
+// SetAccepting sets whether new keys may be registered to this node (e.g.,
+// so that an operator can stop a node from taking on more keys). Even if
+// accepting is true, the node stops accepting keys when its storage is
+// fuller than n.CapacityWatermark. The change is published to the cluster
+// immediately if this node is a member of the cluster.
+func (n *Node) SetAccepting(accepting bool) error {
+	n.infoMu.Lock()
+	n.refuseKeys = !accepting
+	n.infoMu.Unlock()
+
+	return n.publishInfoIfMember()
+}
+
+// publishInfoIfMember publishes this node's NodeInfo if this node is a member
+// of the cluster. (Otherwise, publishing it would create the membership
+// directory without a TTL.)
+func (n *Node) publishInfoIfMember() error {
+	if _, err := n.backend.Get(keyPathJoin(nodesPrefix, n.Name)); err == ErrKeyNotExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return n.publishInfo()
+}
+
+// Info returns this node's current NodeInfo.
+func (n *Node) Info() (*NodeInfo, error) {
+	n.infoMu.Lock()
+	refuseKeys, draining, overMaxBytes := n.refuseKeys, n.draining, n.overMaxBytes
+	n.infoMu.Unlock()
+
+	info := &NodeInfo{Accepting: !refuseKeys && !draining && !overMaxBytes, Draining: draining, EvictedKeys: n.recentlyEvicted(), Labels: n.Labels, Time: time.Now()}
+
+	keys, err := n.registry.KeysForNode(n.Name)
+	if err != nil {
+		return nil, err
+	}
+	info.Keys = len(keys)
+
+	if stater, ok := n.Provider.(KeyStater); ok {
+		for _, key := range keys {
+			stat, err := stater.Stat(key)
+			if err == ErrKeyNotExist {
+				// Not fetched yet.
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			info.DataBytes += stat.Size
+		}
+	}
+
+	if cp, ok := n.Provider.(CapacityProvider); ok {
+		info.FreeBytes, info.TotalBytes, err = cp.Capacity()
+		if err != nil {
+			return nil, err
+		}
+		watermark := n.CapacityWatermark
+		if watermark == 0 {
+			watermark = DefaultCapacityWatermark
+		}
+		if info.FreeBytes == 0 || (info.TotalBytes > 0 && float64(info.TotalBytes-info.FreeBytes)/float64(info.TotalBytes) > watermark) {
+			info.Accepting = false
+		}
+	}
+	if lp, ok := n.Provider.(LoadProvider); ok {
+		info.RequestRate, err = lp.RequestRate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// evicted reports whether key is one of info's EvictedKeys.
+func (info *NodeInfo) evicted(key string) bool {
+	key = keyPathJoin(key)
+	for _, k := range info.EvictedKeys {
+		if keyPathJoin(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// publishInfo publishes this node's NodeInfo to the cluster. It must only be
+// called when this node is a member of the cluster.
+func (n *Node) publishInfo() error {
+	info, err := n.Info()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := n.backend.Set(keyPathJoin(nodesPrefix, n.Name, nodeInfoFile), string(data)); err != nil {
+		return err
+	}
+
+	n.infoMu.Lock()
+	n.infoPublished = info.Time
+	n.infoMu.Unlock()
+	if !info.Accepting {
+		n.logf("Node %s is not accepting new keys (%d keys, %d/%d bytes free).", n.Name, info.Keys, info.FreeBytes, info.TotalBytes)
+	}
+	return nil
+}
+
+// NodeInfo returns the NodeInfo most recently published by node. If node has
+// not published any (e.g., because it just joined the cluster),
+// ErrKeyNotExist is returned.
+func (c *Client) NodeInfo(node string) (*NodeInfo, error) {
+	v, err := c.backend.Get(keyPathJoin(nodesPrefix, node, nodeInfoFile))
+	if err != nil {
+		return nil, err
+	}
+	var info NodeInfo
+	if err := json.Unmarshal([]byte(v), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// acceptingNodes returns the nodes (in order) that are members of the
+// cluster and accept new keys. Members whose info is missing (e.g., because
+// they just joined the cluster) or invalid are assumed to accept keys.
+func (c *Client) acceptingNodes(nodes []string) ([]string, error) {
+	return c.filterNodeInfo(nodes, func(info *NodeInfo) bool { return info.Accepting })
+}
+
+// acceptingNodesForKey is like acceptingNodes, but it also excludes the nodes
+// that recently evicted key (so that key is not registered to a node that
+// will just evict it again).
+func (c *Client) acceptingNodesForKey(key string, nodes []string) ([]string, error) {
+	return c.filterNodeInfo(nodes, func(info *NodeInfo) bool {
+		return info.Accepting && !info.evicted(key)
+	})
+}
+
+// filterNodeInfo returns the nodes (in order) that are members of the cluster
+// and whose info satisfies ok. Members whose info is missing or invalid are
+// included.
+func (c *Client) filterNodeInfo(nodes []string, ok func(*NodeInfo) bool) ([]string, error) {
+	var accepting []string
+	for _, node := range nodes {
+		v, err := c.backend.Get(keyPathJoin(nodesPrefix, node, nodeInfoFile))
+		if err == ErrKeyNotExist {
+			// The node's info (which expires along with its membership) is
+			// missing, so check that the node is still a member.
+			if member, err := c.isMember(node); err != nil {
+				return nil, err
+			} else if member {
+				accepting = append(accepting, node)
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var info NodeInfo
+		if err := json.Unmarshal([]byte(v), &info); err != nil {
+			c.logf("Ignoring invalid info for node %s: %s.", node, err)
+			info = NodeInfo{Accepting: true}
+		}
+		if ok(&info) {
+			accepting = append(accepting, node)
+		}
+	}
+	return accepting, nil
+}
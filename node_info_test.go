@@ -0,0 +1,109 @@
+package datad
+
+import (
+	"reflect"
+	"testing"
+)
+
+type capacityProvider struct {
+	NoopProvider
+	free, total uint64
+}
+
+func (p capacityProvider) Capacity() (free, total uint64, err error) { return p.free, p.total, nil }
+
+func TestNode_Info(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	c.Replication.Default = 2
+
+	full := NewNode("full:80", b, capacityProvider{free: 5, total: 100})
+	roomy := NewNode("roomy:80", b, capacityProvider{free: 50, total: 100})
+
+	// SetAccepting doesn't make a node a member of the cluster.
+	must(t, roomy.SetAccepting(true))
+	if nodes, err := c.NodesInCluster(); err != nil || len(nodes) != 0 {
+		t.Errorf("got NodesInCluster == %v, %v, want none", nodes, err)
+	}
+
+	must(t, full.refreshClusterMembership())
+	must(t, roomy.refreshClusterMembership())
+
+	info, err := c.NodeInfo(full.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Accepting || info.FreeBytes != 5 || info.TotalBytes != 100 {
+		t.Errorf("got full node info %+v, want not accepting with 5/100 bytes free", info)
+	}
+	if info, err := c.NodeInfo(roomy.Name); err != nil || !info.Accepting {
+		t.Errorf("got roomy node info %+v, %v, want accepting", info, err)
+	}
+
+	// Keys are only registered to nodes that accept them.
+	nodes, err := c.Update("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{roomy.Name}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got Update == %v, want %v", nodes, want)
+	}
+	if info, err := roomy.Info(); err != nil || info.Keys != 1 {
+		t.Errorf("got roomy node info %+v, %v, want 1 key", info, err)
+	}
+
+	must(t, roomy.SetAccepting(false))
+	if _, err := c.Update("k2"); err != ErrNoAvailableNodesForRegistration {
+		t.Errorf("got Update error %v, want ErrNoAvailableNodesForRegistration", err)
+	}
+
+	// A full node still accepts keys if its watermark is high enough.
+	full.CapacityWatermark = 0.99
+	must(t, full.SetAccepting(true))
+	if nodes, err := c.Update("k2"); err != nil || !reflect.DeepEqual(nodes, []string{full.Name}) {
+		t.Errorf("got Update == %v, %v, want [%s]", nodes, err, full.Name)
+	}
+}
+
+// Test that a node publishes its info again as soon as it rejoins the cluster
+// after its membership (and info) expired.
+func TestNode_Info_Rejoin(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n := NewNode("n:80", b, NoopProvider{})
+
+	must(t, n.refreshClusterMembership())
+	must(t, n.SetAccepting(false))
+
+	// Expire the node's membership.
+	must(t, b.DeleteDir(keyPathJoin(nodesPrefix, n.Name)))
+	if _, err := c.NodeInfo(n.Name); err != ErrKeyNotExist {
+		t.Fatalf("got NodeInfo error %v after membership expired, want ErrKeyNotExist", err)
+	}
+
+	must(t, n.refreshClusterMembership())
+	if info, err := c.NodeInfo(n.Name); err != nil || info.Accepting {
+		t.Errorf("got node info %+v, %v after rejoining, want not accepting", info, err)
+	}
+	if accepting, err := c.acceptingNodes([]string{n.Name}); err != nil || len(accepting) != 0 {
+		t.Errorf("got acceptingNodes == %v, %v after rejoining, want none", accepting, err)
+	}
+}
+
+// Test that a node reports the size of its data for its registered keys.
+func TestNode_Info_DataBytes(t *testing.T) {
+	b := NewMemoryBackend()
+	p := statingProvider{removingProvider{noopUpdateProvider{data{
+		"/a": {"0123456789"},
+		"/b": {"01234"},
+		"/c": {"0123456789"}, // not registered
+	}}, make(chan string, 10)}}
+	n := NewNode("n:80", b, p)
+	must(t, n.registry.Add("a", n.Name))
+	must(t, n.registry.Add("b", n.Name))
+	must(t, n.registry.Add("x", n.Name)) // not fetched
+
+	if info, err := n.Info(); err != nil || info.DataBytes != 15 {
+		t.Errorf("got info %+v, %v, want 15 data bytes", info, err)
+	}
+}
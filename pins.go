@@ -0,0 +1,224 @@
+package datad
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	pinnedPrefix = "/pinned"
+
+	// keyPinFile marks a key as pinned. Each pinned key has a directory (so
+	// that a key and the keys beneath it may be pinned independently).
+	keyPinFile = "$$pin"
+)
+
+func pinnedKeyFile(key string) string {
+	return keyPathJoin(registryPrefix, pinnedPrefix, key, keyPinFile)
+}
+
+// Pin adds key to the list of pinned keys, which must always be available.
+// Pinned keys are kept at ReplicationPolicy.Pinned replicas (if that is more
+// than they would otherwise have), and they are never evicted to free space.
+// When a node that holds a pinned key leaves the cluster, the key is
+// registered to another node immediately, and nodes fetch the pinned keys
+// that are placed on them when they join the cluster. Pinning a key that is
+// already pinned has no effect.
+func (r *Registry) Pin(key string) error {
+	return r.backend.Set(pinnedKeyFile(key), "")
+}
+
+// Unpin removes key from the list of pinned keys. If key is not pinned,
+// ErrKeyNotExist is returned.
+func (r *Registry) Unpin(key string) error {
+	return r.backend.Delete(pinnedKeyFile(key))
+}
+
+// IsPinned reports whether key is pinned.
+func (r *Registry) IsPinned(key string) (bool, error) {
+	_, err := r.backend.Get(pinnedKeyFile(key))
+	if err == ErrKeyNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Pinned returns the list of pinned keys.
+func (r *Registry) Pinned() ([]string, error) {
+	bkeys, err := r.backend.ListKeys(keyPathJoin(registryPrefix, pinnedPrefix), true)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, bk := range bkeys {
+		if key := strings.TrimSuffix(bk, "/"+keyPinFile); key != bk {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// pinnedSet returns the set of pinned keys (normalized with keyPathJoin).
+func (r *Registry) pinnedSet() (map[string]bool, error) {
+	keys, err := r.Pinned()
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		pinned[keyPathJoin(key)] = true
+	}
+	return pinned, nil
+}
+
+// Pin pins key (see Registry.Pin) and registers it to as many nodes as
+// c.Replication requires for pinned keys. It returns the nodes that key is
+// registered to.
+func (c *Client) Pin(key string) (nodes []string, err error) {
+	if err := c.registry.Pin(key); err != nil {
+		return nil, err
+	}
+	return c.register(key, nil, nil, nil)
+}
+
+// Unpin unpins key (see Registry.Unpin). Nodes that hold key beyond the
+// number of replicas that it needs when unpinned keep it until they evict
+// it.
+func (c *Client) Unpin(key string) error {
+	return c.registry.Unpin(key)
+}
+
+// Pinned returns the list of pinned keys.
+func (c *Client) Pinned() ([]string, error) {
+	return c.registry.Pinned()
+}
+
+// replicas returns the number of nodes that key should be registered to,
+// according to c.Replication and whether key is pinned.
+func (c *Client) replicas(key string) (int, error) {
+	pinned, err := c.registry.IsPinned(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Replication.replicas(key, pinned), nil
+}
+
+// watchMembership watches the cluster membership. When a node leaves the
+// cluster and this node is the balancer leader, the pinned keys that were
+// registered to the departed node are registered to other nodes immediately
+// (instead of in the next balance run).
+func (n *Node) watchMembership() error {
+	return n.watch("membership", nodesPrefix, func(ev *WatchEvent) {
+		if !ev.Dir || (ev.Action != WatchDelete && ev.Action != WatchExpire) {
+			return
+		}
+		node := strings.TrimPrefix(ev.Key, nodesPrefix+"/")
+		if node == ev.Key || strings.Contains(node, "/") || !n.IsLeader() {
+			return
+		}
+		go func() {
+			if err := n.replacePinned(node); err != nil {
+				n.logf("Failed to register pinned keys of departed node %s to other nodes: %s.", node, err)
+			}
+		}()
+	})
+}
+
+// replacePinned deregisters the pinned keys registered to node (which left
+// the cluster) from it, and registers them to other nodes.
+func (n *Node) replacePinned(node string) error {
+	keys, err := n.registry.Pinned()
+	if err != nil {
+		return err
+	}
+	c := n.client()
+	for _, key := range keys {
+		nodes, err := c.NodesForKey(key)
+		if err != nil {
+			return err
+		}
+		if !containsString(nodes, node) {
+			continue
+		}
+		n.logf("Node %s, which held pinned key %q, left the cluster; registering the key to other nodes.", node, key)
+		if err := c.registry.Remove(key, node); err != nil && err != ErrKeyNotExist && err != ErrCompareFailed {
+			return err
+		}
+		if _, err := c.register(key, removeString(nodes, node), nil, nil); err != nil && err != ErrNoAvailableNodesForRegistration {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefetchPinned registers the pinned keys that are placed on this node (as
+// one of each key's replicas) to this node, so that it fetches them as soon
+// as it joins the cluster. A key that already has all of its replicas is
+// moved to this node from one of them, so that it doesn't stay above its
+// replication count. It should be called after registerExistingKeys, so that
+// the pinned keys that this node already has aren't fetched again.
+func (n *Node) prefetchPinned() error {
+	keys, err := n.registry.Pinned()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	c := n.client()
+	clusterNodes, err := c.NodesInCluster()
+	if err != nil {
+		return err
+	}
+	acceptingNodes, err := c.acceptingNodes(clusterNodes)
+	if err != nil {
+		return err
+	}
+	moves, err := c.registry.moves()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		placed := c.placement().Nodes(key, acceptingNodes)
+		replicas := c.Replication.replicas(key, true)
+		if len(placed) > replicas {
+			placed = placed[:replicas]
+		}
+		if !containsString(placed, n.Name) {
+			continue
+		}
+		nodes, err := n.registry.NodesForKey(key)
+		if err != nil && err != ErrKeyNotExist {
+			return err
+		}
+		if containsString(nodes, n.Name) {
+			continue
+		}
+
+		// If the key already has all of its replicas, this node replaces
+		// the registered node that the placement ranks lowest (among those
+		// it doesn't place the key on). That is recorded as a move, so that
+		// the balancer leader deregisters the replaced node only once this
+		// node has fetched the key.
+		_, moving := moves[keyPathJoin(key)]
+		if len(nodes) >= replicas && !moving {
+			ranked := c.placement().Nodes(key, nodes)
+			for i := len(ranked) - 1; i >= 0; i-- {
+				if !containsString(placed, ranked[i]) {
+					n.logf("Prefetching pinned key %q in place of node %s.", key, ranked[i])
+					if err := c.registry.startMove(key, keyMove{From: ranked[i], To: n.Name, Started: time.Now()}); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		} else {
+			n.logf("Prefetching pinned key %q.", key)
+		}
+		if err := n.registry.Add(key, n.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
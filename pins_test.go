@@ -0,0 +1,174 @@
+package datad
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Pin(t *testing.T) {
+	r := NewRegistry(NewMemoryBackend())
+
+	must(t, r.Pin("a"))
+	must(t, r.Pin("a/b"))
+	must(t, r.Pin("a")) // pinning again has no effect
+
+	pinned, err := r.Pinned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(pinned)
+	if want := []string{"a", "a/b"}; !reflect.DeepEqual(pinned, want) {
+		t.Errorf("got Pinned == %v, want %v", pinned, want)
+	}
+
+	must(t, r.Unpin("a"))
+	if err := r.Unpin("a"); err != ErrKeyNotExist {
+		t.Errorf("got Unpin error %v for unpinned key, want ErrKeyNotExist", err)
+	}
+	for key, want := range map[string]bool{"a": false, "/a/b": true, "c": false} {
+		if pinned, err := r.IsPinned(key); err != nil || pinned != want {
+			t.Errorf("%q: got IsPinned == %v, %v, want %v", key, pinned, err, want)
+		}
+	}
+}
+
+func TestClient_Pin(t *testing.T) {
+	b := NewMemoryBackend()
+	for _, node := range []string{"a:80", "b:80", "c:80"} {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	c := NewClient(b)
+	c.Replication = ReplicationPolicy{Default: 1, Pinned: 2}
+
+	if nodes, err := c.Update("k"); err != nil || len(nodes) != 1 {
+		t.Fatalf("got Update == %v, %v, want 1 node", nodes, err)
+	}
+	nodes, err := c.Pin("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regNodes, err := c.NodesForKey("k"); err != nil || len(nodes) != 2 || len(regNodes) != 2 {
+		t.Errorf("got Pin == %v and registered nodes %v, %v, want 2 nodes", nodes, regNodes, err)
+	}
+
+	// A pinned key is not evicted.
+	n := NewNode(nodes[0], b, NoopProvider{})
+	must(t, c.registry.SetStatus("k", nodes[0], RegistrationStatus{State: StateReady}))
+	if ok, err := n.canEvict("k"); err != nil || ok {
+		t.Errorf("got canEvict == %v, %v for pinned key, want false", ok, err)
+	}
+	must(t, c.Unpin("k"))
+	if ok, err := n.canEvict("k"); err != nil || !ok {
+		t.Errorf("got canEvict == %v, %v for unpinned key, want true", ok, err)
+	}
+}
+
+// Test that the leader registers pinned keys to other nodes as soon as a
+// node that holds them leaves the cluster.
+func TestNode_ReplacePinned(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n := NewNode("n:80", b, NoopProvider{})
+	n.Replication.Pinned = 2
+	must(t, n.Start())
+	defer n.Stop()
+	waitForLeader(t, n)
+
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, "dying:80"), 0))
+	must(t, c.registry.Pin("k"))
+	must(t, c.registry.Add("k", "dying:80"))
+	must(t, c.registry.Add("unpinned", "dying:80"))
+
+	must(t, b.DeleteDir(keyPathJoin(nodesPrefix, "dying:80")))
+	for i := 0; i < 100; i++ {
+		if nodes, _ := c.NodesForKey("k"); reflect.DeepEqual(nodes, []string{n.Name}) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nodes, err := c.NodesForKey("k"); err != nil || !reflect.DeepEqual(nodes, []string{n.Name}) {
+		t.Errorf("got NodesForKey == %v, %v for pinned key, want %v", nodes, err, []string{n.Name})
+	}
+	if nodes, err := c.NodesForKey("unpinned"); err != nil || !reflect.DeepEqual(nodes, []string{"dying:80"}) {
+		t.Errorf("got NodesForKey == %v, %v for unpinned key, want it left for the balancer", nodes, err)
+	}
+}
+
+func TestNode_PrefetchPinned(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	for _, node := range []string{"a:80", "b:80", "c:80"} {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k6"} {
+		must(t, r.Pin(key))
+	}
+
+	n := NewNode("a:80", b, NoopProvider{})
+	n.Replication.Pinned = 2
+	must(t, n.prefetchPinned())
+
+	// The node is registered for exactly the pinned keys that are placed
+	// on it.
+	registered, err := r.KeysForNode(n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(registered)
+	var want []string
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5", "k6"} {
+		if containsString(RendezvousPlacement{}.Nodes(key, []string{"a:80", "b:80", "c:80"})[:2], n.Name) {
+			want = append(want, key)
+		}
+	}
+	if !reflect.DeepEqual(registered, want) {
+		t.Errorf("got registered keys %v, want %v", registered, want)
+	}
+}
+
+// Test that prefetching a pinned key that already has all of its replicas
+// moves it from a replica it isn't placed on, instead of adding a replica.
+func TestNode_PrefetchPinned_Replicated(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	c.Replication.Pinned = 2
+	all := []string{"a:80", "b:80", "c:80"}
+	for _, node := range all {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+
+	// Find a key that is placed on a:80, and register it to the other
+	// nodes.
+	var key string
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("k%d", i); containsString(RendezvousPlacement{}.Nodes(k, all)[:2], "a:80") {
+			key = k
+		}
+	}
+	must(t, c.registry.Pin(key))
+	for _, node := range all[1:] {
+		must(t, c.registry.add(key, node, RegistrationStatus{State: StateReady}, ReasonAssigned))
+	}
+
+	n := NewNode("a:80", b, NoopProvider{})
+	n.Replication.Pinned = 2
+	must(t, n.prefetchPinned())
+	must(t, c.registry.SetStatus(key, n.Name, RegistrationStatus{State: StateReady}))
+	if finished, err := n.finishMoves(c); err != nil || finished != 1 {
+		t.Fatalf("got finishMoves == %d, %v, want 1 move finished", finished, err)
+	}
+
+	nodes, err := c.NodesForKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RendezvousPlacement{}.Nodes(key, all)[:2]
+	sort.Strings(nodes)
+	sort.Strings(want)
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
+}
@@ -0,0 +1,61 @@
+package datad
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// A Placement decides which cluster nodes each key is registered to.
+//
+// All clients and nodes in a cluster should use the same Placement, so that
+// they choose the same nodes when registering the same key concurrently.
+type Placement interface {
+	// Nodes returns nodes (the members of the cluster) ordered by preference
+	// for holding key: replicas of key are registered to the first nodes in
+	// the returned list that key is not already registered to. The result
+	// must depend only on key and the set of nodes (not on their order), and
+	// nodes must not be modified.
+	Nodes(key string, nodes []string) []string
+}
+
+// RendezvousPlacement is a Placement that uses rendezvous (highest random
+// weight) hashing: each node's preference for a key is a hash of the node and
+// the key. When a node joins or leaves a cluster of N nodes, only about 1/N
+// of keys change their most preferred node.
+//
+// It is the default Placement of Clients and Nodes.
+type RendezvousPlacement struct{}
+
+func (RendezvousPlacement) Nodes(key string, nodes []string) []string {
+	weights := make(map[string]uint64, len(nodes))
+	for _, node := range nodes {
+		weights[node] = rendezvousWeight(key, node)
+	}
+	ordered := append([]string(nil), nodes...)
+	sort.Slice(ordered, func(i, j int) bool {
+		wi, wj := weights[ordered[i]], weights[ordered[j]]
+		if wi != wj {
+			return wi > wj
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
+}
+
+// rendezvousWeight returns the weight of node for key.
+func rendezvousWeight(key, node string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(node))
+	x := h.Sum64()
+
+	// FNV's low-order bits mix poorly for similar inputs, so finish with the
+	// MurmurHash3 64-bit finalizer.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
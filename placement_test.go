@@ -0,0 +1,68 @@
+package datad
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRendezvousPlacement(t *testing.T) {
+	var p RendezvousPlacement
+	nodes := []string{"a:80", "b:80", "c:80", "d:80"}
+
+	got := p.Nodes("k", nodes)
+	sorted := append([]string(nil), got...)
+	sort.Strings(sorted)
+	if !reflect.DeepEqual(sorted, nodes) {
+		t.Fatalf("got Nodes == %v, want a permutation of %v", got, nodes)
+	}
+	if want := []string{"a:80", "b:80", "c:80", "d:80"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Nodes modified its argument: got %v, want %v", nodes, want)
+	}
+	reversed := []string{"d:80", "c:80", "b:80", "a:80"}
+	if got2 := p.Nodes("k", reversed); !reflect.DeepEqual(got2, got) {
+		t.Errorf("got Nodes == %v for reordered nodes, want %v", got2, got)
+	}
+}
+
+func TestRendezvousPlacement_Distribution(t *testing.T) {
+	var p RendezvousPlacement
+	const numKeys = 10000
+
+	var nodes []string
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, fmt.Sprintf("node%d:80", i))
+	}
+
+	first := make(map[string]string, numKeys)
+	counts := make(map[string]int)
+	for i := 0; i < numKeys; i++ {
+		// Use similar keys, which the old byte-sum bucketing mapped to few
+		// buckets.
+		key := fmt.Sprintf("github.com/user/repo%d", i)
+		first[key] = p.Nodes(key, nodes)[0]
+		counts[first[key]]++
+	}
+	for _, node := range nodes {
+		if c := counts[node]; c < numKeys/len(nodes)/2 || c > 2*numKeys/len(nodes) {
+			t.Errorf("node %s is preferred for %d/%d keys, want about %d", node, c, numKeys, numKeys/len(nodes))
+		}
+	}
+
+	// Adding a node should only move keys to the new node, and only about
+	// 1/N of them.
+	newNode := "node10:80"
+	moved := 0
+	for key, node := range first {
+		if now := p.Nodes(key, append(nodes, newNode))[0]; now != node {
+			if now != newNode {
+				t.Fatalf("key %q moved from %s to %s, not to the new node", key, node, now)
+			}
+			moved++
+		}
+	}
+	if want := numKeys / (len(nodes) + 1); moved < want/2 || moved > 2*want {
+		t.Errorf("adding a node moved %d/%d keys, want about %d", moved, numKeys, want)
+	}
+}
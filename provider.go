@@ -1,5 +1,7 @@
 package datad
 
+import "time"
+
 // A Provider makes data accessible to the datad cluster.
 type Provider interface {
 	// HasKey returns whether this provider has the underlying data for key. If
@@ -14,3 +16,67 @@ type Provider interface {
 	// be created.
 	Update(key string) error
 }
+
+// A KeyWalker is a Provider that can enumerate its keys incrementally, which
+// lets a node register its existing keys as they are found (instead of after
+// all of them are found, as with Keys). Providers with many keys, or whose
+// keys are slow to enumerate, should implement it.
+type KeyWalker interface {
+	Provider
+
+	// WalkKeys calls fn with each key under keyPrefix as it is found. If fn
+	// returns an error, WalkKeys stops walking and returns that error.
+	WalkKeys(keyPrefix string, fn func(key string) error) error
+}
+
+// A KeyRemover is a Provider that can remove its data for a key. Nodes whose
+// provider implements KeyRemover remove their data for keys that are
+// deregistered from them (after Node.EvictionGracePeriod).
+type KeyRemover interface {
+	Provider
+
+	// Remove removes this provider's data for key. If the provider does not
+	// have key's data, it returns ErrKeyNotExist.
+	Remove(key string) error
+}
+
+// A KeyStater is a Provider that can report the size of its data for each
+// key. Nodes whose provider implements KeyStater and KeyRemover evict the
+// least recently used keys when their data exceeds Node.MaxBytes.
+type KeyStater interface {
+	Provider
+
+	// Stat returns information about this provider's data for key. If the
+	// provider does not have key's data, it returns ErrKeyNotExist.
+	Stat(key string) (*KeyStat, error)
+}
+
+// KeyStat describes a provider's data for a key.
+type KeyStat struct {
+	// Size is the size of the data on disk, in bytes.
+	Size uint64
+
+	// Accessed is when the data was last accessed, or the zero time if the
+	// provider doesn't know. Nodes also track accesses themselves (see
+	// Node.RecordAccess); the later of the two times is used.
+	Accessed time.Time
+}
+
+// walkKeys calls fn with each of p's keys under keyPrefix, using WalkKeys if
+// p is a KeyWalker, and Keys otherwise.
+func walkKeys(p Provider, keyPrefix string, fn func(key string) error) error {
+	if w, ok := p.(KeyWalker); ok {
+		return w.WalkKeys(keyPrefix, fn)
+	}
+
+	keys, err := p.Keys(keyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
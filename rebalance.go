@@ -0,0 +1,340 @@
+package datad
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// DefaultMoveBudget is the default value of Node.MoveBudget.
+	DefaultMoveBudget = 10
+
+	// LoadImbalanceThreshold is how far above the cluster's average load (as
+	// a fraction of the average) a node's load must be before the balancer
+	// leader moves keys off it.
+	LoadImbalanceThreshold = 0.25
+)
+
+// A LoadProvider is a Provider that can report how much traffic its data
+// receives. The balancer leader moves keys off nodes that receive much more
+// traffic than others.
+type LoadProvider interface {
+	Provider
+
+	// RequestRate returns the recent rate (in requests per second) of
+	// requests for the provider's data on this node.
+	RequestRate() (float64, error)
+}
+
+// nodeLoad is the load on a node, as measured by the balancer.
+type nodeLoad struct {
+	keys  float64 // number of keys registered to the node
+	bytes float64 // bytes of data or storage used (if reported; see clusterLoads)
+	rate  float64 // requests per second (if reported)
+}
+
+// relativeTo returns l relative to avg, where 1 means that l is average. It
+// is the largest ratio of any of l's measures to the corresponding measure of
+// avg (ignoring measures whose average is 0, which aren't reported).
+func (l nodeLoad) relativeTo(avg nodeLoad) float64 {
+	var rel float64
+	for _, m := range [][2]float64{{l.keys, avg.keys}, {l.bytes, avg.bytes}, {l.rate, avg.rate}} {
+		if m[1] > 0 && m[0]/m[1] > rel {
+			rel = m[0] / m[1]
+		}
+	}
+	return rel
+}
+
+// perKey returns the share of l that each of its keys accounts for (on
+// average).
+func (l nodeLoad) perKey() nodeLoad {
+	if l.keys == 0 {
+		return nodeLoad{}
+	}
+	return nodeLoad{keys: 1, bytes: l.bytes / l.keys, rate: l.rate / l.keys}
+}
+
+func (l nodeLoad) add(m nodeLoad, sign float64) nodeLoad {
+	return nodeLoad{keys: l.keys + sign*m.keys, bytes: l.bytes + sign*m.bytes, rate: l.rate + sign*m.rate}
+}
+
+// A keyMove is a move of a key from one node to another that the balancer
+// leader started. The key is registered to both nodes until the destination
+// node has the key's data. Moves in progress are recorded in the registry, so
+// that if the leader changes, the new leader finishes them.
+type keyMove struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Started time.Time `json:"started"`
+}
+
+const (
+	movesPrefix = "/moves"
+
+	// keyMoveFile holds a key's move in progress (as JSON).
+	keyMoveFile = "$$move"
+)
+
+func movingKeyFile(key string) string {
+	return keyPathJoin(registryPrefix, movesPrefix, key, keyMoveFile)
+}
+
+// startMove records that a move of key is in progress.
+func (r *Registry) startMove(key string, m keyMove) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return r.backend.Set(movingKeyFile(key), string(data))
+}
+
+// endMove removes the record of key's move (which finished or was
+// abandoned).
+func (r *Registry) endMove(key string) error {
+	err := r.backend.Delete(movingKeyFile(key))
+	if err == ErrKeyNotExist {
+		return nil
+	}
+	return err
+}
+
+// moves returns the moves in progress (by key, normalized with keyPathJoin).
+// Invalid records are ignored.
+func (r *Registry) moves() (map[string]keyMove, error) {
+	bkeys, err := r.backend.ListKeys(keyPathJoin(registryPrefix, movesPrefix), true)
+	if err != nil {
+		return nil, err
+	}
+	moves := make(map[string]keyMove, len(bkeys))
+	for _, bk := range bkeys {
+		key := strings.TrimSuffix(bk, "/"+keyMoveFile)
+		if key == bk {
+			continue
+		}
+		v, err := r.backend.Get(movingKeyFile(key))
+		if err == ErrKeyNotExist {
+			// Finished concurrently.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var m keyMove
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			log.Printf("Ignoring invalid move of key %q in registry: %s.", key, err)
+			continue
+		}
+		moves[keyPathJoin(key)] = m
+	}
+	return moves, nil
+}
+
+// clusterLoads returns the load on each of clusterNodes, and the average
+// load. Key counts are taken from keyMap, and the other measures from each
+// node's published NodeInfo. The bytes measure is the size of the node's
+// data (NodeInfo.DataBytes) if the node reports it, or else the used space of
+// the node's storage (which may hold more than the node's data).
+func (c *Client) clusterLoads(keyMap map[string][]string, clusterNodes []string) (map[string]nodeLoad, nodeLoad, error) {
+	loads := make(map[string]nodeLoad, len(clusterNodes))
+	for _, node := range clusterNodes {
+		loads[node] = nodeLoad{}
+	}
+	for _, nodes := range keyMap {
+		for _, node := range nodes {
+			if l, ok := loads[node]; ok {
+				l.keys++
+				loads[node] = l
+			}
+		}
+	}
+
+	var total nodeLoad
+	for node, l := range loads {
+		info, err := c.NodeInfo(node)
+		if err == nil {
+			if info.DataBytes > 0 {
+				l.bytes = float64(info.DataBytes)
+			} else {
+				l.bytes = float64(info.TotalBytes - info.FreeBytes)
+			}
+			l.rate = info.RequestRate
+			loads[node] = l
+		} else if err != ErrKeyNotExist {
+			c.logf("Ignoring invalid info for node %s: %s.", node, err)
+		}
+		total = total.add(l, 1)
+	}
+	if len(loads) == 0 {
+		return loads, nodeLoad{}, nil
+	}
+	n := float64(len(loads))
+	return loads, nodeLoad{keys: total.keys / n, bytes: total.bytes / n, rate: total.rate / n}, nil
+}
+
+// rebalanceLoad moves keys from nodes whose load is more than
+// LoadImbalanceThreshold above the cluster's average to the least loaded
+// nodes that accept keys. It starts at most n.MoveBudget moves (minus the
+// moves that are still in progress), and it returns the number of moves it
+// started. Each move registers the key to the destination node; the key is
+// deregistered from the source node by a later call to finishMoves (possibly
+// by another leader), once the destination node has the key's data.
+func (n *Node) rebalanceLoad(c *Client, keyMap map[string][]string, clusterNodes, acceptingNodes []string) (int, error) {
+	budget := n.MoveBudget
+	if budget == 0 {
+		budget = DefaultMoveBudget
+	}
+	inProgress, err := c.registry.moves()
+	if err != nil {
+		return 0, err
+	}
+	budget -= len(inProgress)
+	if budget <= 0 || len(clusterNodes) < 2 {
+		return 0, nil
+	}
+
+	loads, avg, err := c.clusterLoads(keyMap, clusterNodes)
+	if err != nil {
+		return 0, err
+	}
+
+	// Index the keys registered to each node (in a stable order).
+	nodeKeys := map[string][]string{}
+	for key, nodes := range keyMap {
+		for _, node := range nodes {
+			nodeKeys[node] = append(nodeKeys[node], key)
+		}
+	}
+	for _, keys := range nodeKeys {
+		sort.Strings(keys)
+	}
+
+	// extreme returns the node (among nodes) with the highest load if most
+	// is true, or with the lowest load otherwise.
+	extreme := func(nodes []string, most bool) (string, float64) {
+		var best string
+		var bestRel float64
+		for _, node := range nodes {
+			rel := loads[node].relativeTo(avg)
+			if best == "" || (most && rel > bestRel) || (!most && rel < bestRel) {
+				best, bestRel = node, rel
+			}
+		}
+		return best, bestRel
+	}
+
+	moves := 0
+	sources := append([]string{}, clusterNodes...)
+	for moves < budget && len(sources) > 0 {
+		from, fromRel := extreme(sources, true)
+		if fromRel <= 1+LoadImbalanceThreshold {
+			break
+		}
+
+		// Choose a key on the source node that the least loaded node that
+		// doesn't already have it could take.
+		var key, to string
+		for _, k := range nodeKeys[from] {
+			if _, moving := inProgress[keyPathJoin(k)]; moving {
+				continue
+			}
+			var targets []string
+			for _, node := range acceptingNodes {
+				if node != from && !containsString(keyMap[k], node) {
+					targets = append(targets, node)
+				}
+			}
+			if t, _ := extreme(targets, false); t != "" {
+				key, to = k, t
+				break
+			}
+		}
+
+		// Only move the key if the move makes the cluster more balanced.
+		share := loads[from].perKey()
+		if key == "" || loads[to].add(share, 1).relativeTo(avg) >= loads[from].add(share, -1).relativeTo(avg) {
+			sources = removeString(sources, from)
+			continue
+		}
+
+		// Check the destination again now, since it might have left the
+		// cluster or stopped accepting keys since acceptingNodes was
+		// computed (or it might have recently evicted the key).
+		if ok, err := c.acceptingNodesForKey(key, []string{to}); err != nil {
+			return moves, err
+		} else if len(ok) == 0 {
+			acceptingNodes = removeString(append([]string{}, acceptingNodes...), to)
+			continue
+		}
+
+		n.logf("Balancer: moving key %q from overloaded node %s (load %.2f of average) to node %s (load %.2f of average).", key, from, fromRel, to, loads[to].relativeTo(avg))
+		// Record the move first, so that it is finished (or abandoned) even
+		// if this node stops before it finishes.
+		if err := c.registry.startMove(key, keyMove{From: from, To: to, Started: time.Now()}); err != nil {
+			return moves, err
+		}
+		if err := c.registry.Add(key, to); err != nil {
+			return moves, err
+		}
+		moves++
+
+		loads[from] = loads[from].add(share, -1)
+		loads[to] = loads[to].add(share, 1)
+		keyMap[key] = append(keyMap[key], to)
+		nodeKeys[from] = removeString(nodeKeys[from], key)
+	}
+	return moves, nil
+}
+
+// finishMoves completes the moves started by rebalanceLoad (on this node or
+// on an earlier leader) whose destination node has fetched the key, by
+// deregistering the key from the source node. Moves whose destination node
+// failed to fetch the key are abandoned (and the key is deregistered from the
+// destination node instead). It returns the number of moves that were
+// completed or abandoned.
+func (n *Node) finishMoves(c *Client) (int, error) {
+	moves, err := c.registry.moves()
+	if err != nil {
+		return 0, err
+	}
+
+	finished := 0
+	for key, m := range moves {
+		statuses, err := c.registry.Statuses(key)
+		if err != nil {
+			return finished, err
+		}
+		status, registered := statuses[m.To]
+		switch {
+		case !registered:
+			// The destination node was deregistered (e.g., because it
+			// left the cluster), so there is nothing to finish.
+		case status.Ready():
+			n.logf("Balancer: node %s fetched moved key %q (%s after the move started); deregistering it from node %s.", m.To, key, time.Since(m.Started), m.From)
+			if err := c.registry.Remove(key, m.From); err == ErrCompareFailed {
+				// Retry in the next balance run.
+				continue
+			} else if err != nil && err != ErrKeyNotExist {
+				return finished, err
+			}
+		case status.State == StateFailed:
+			n.logf("Balancer: node %s failed to fetch moved key %q (%s); leaving it on node %s.", m.To, key, status.Error, m.From)
+			if err := c.registry.Remove(key, m.To); err == ErrCompareFailed {
+				continue
+			} else if err != nil && err != ErrKeyNotExist {
+				return finished, err
+			}
+		default:
+			// Still fetching.
+			continue
+		}
+
+		if err := c.registry.endMove(key); err != nil {
+			return finished, err
+		}
+		finished++
+	}
+	return finished, nil
+}
@@ -0,0 +1,178 @@
+package datad
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNodeLoad_RelativeTo(t *testing.T) {
+	avg := nodeLoad{keys: 10, bytes: 100}
+	tests := []struct {
+		load nodeLoad
+		want float64
+	}{
+		{nodeLoad{keys: 10, bytes: 100}, 1},
+		{nodeLoad{keys: 20, bytes: 50}, 2},
+		{nodeLoad{keys: 5, bytes: 300}, 3},
+		{nodeLoad{keys: 10, bytes: 100, rate: 1000}, 1}, // rate is not reported
+	}
+	for _, test := range tests {
+		if got := test.load.relativeTo(avg); got != test.want {
+			t.Errorf("%+v: got %v, want %v", test.load, got, test.want)
+		}
+	}
+}
+
+func TestNode_RebalanceLoad(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n := NewNode("n1:80", b, NoopProvider{})
+	n.MoveBudget = 3
+	inProgress := func() map[string]keyMove {
+		moves, err := c.registry.moves()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return moves
+	}
+
+	nodes := []string{"n1:80", "n2:80", "n3:80"}
+	for _, node := range nodes {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	for i := 0; i < 12; i++ {
+		must(t, c.registry.add(fmt.Sprintf("k%02d", i), "n1:80", RegistrationStatus{State: StateReady}, ReasonExisting))
+	}
+
+	keyMap, err := c.registry.KeyMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := n.rebalanceLoad(c, keyMap, nodes, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != n.MoveBudget {
+		t.Errorf("got %d moves, want %d (the move budget)", moved, n.MoveBudget)
+	}
+	if moved, err := n.rebalanceLoad(c, keyMap, nodes, nodes); err != nil || moved != 0 {
+		t.Errorf("got %d moves, %v while moves were in progress, want 0", moved, err)
+	}
+
+	// Moved keys are registered to both nodes until the destination node
+	// has fetched them.
+	if finished, err := n.finishMoves(c); err != nil || finished != 0 {
+		t.Errorf("got %d finished moves, %v before fetching, want 0", finished, err)
+	}
+	for key, m := range inProgress() {
+		if nodes, err := c.NodesForKey(key); err != nil || len(nodes) != 2 {
+			t.Errorf("key %q: got NodesForKey == %v, %v, want both nodes", key, nodes, err)
+		}
+		state := StateReady
+		if key == "/k00" {
+			state = StateFailed
+		}
+		must(t, c.registry.SetStatus(key, m.To, RegistrationStatus{State: state}))
+	}
+	if finished, err := n.finishMoves(c); err != nil || finished != 3 {
+		t.Errorf("got %d finished moves, %v after fetching, want 3", finished, err)
+	}
+
+	// The key that failed to fetch remains on the source node, and the
+	// others are only on their destination node.
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		nodes, err := c.NodesForKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wantSource := key == "k00"; len(nodes) != 1 || (nodes[0] == "n1:80") != wantSource {
+			t.Errorf("key %q: got NodesForKey == %v", key, nodes)
+		}
+	}
+	if moves := inProgress(); len(moves) != 0 {
+		t.Errorf("got %d moves in progress, want none", len(moves))
+	}
+
+	// Keys are moved until no node is overloaded.
+	for i := 0; i < 10; i++ {
+		keyMap, err := c.registry.KeyMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.rebalanceLoad(c, keyMap, nodes, nodes); err != nil {
+			t.Fatal(err)
+		}
+		for key, m := range inProgress() {
+			must(t, c.registry.SetStatus(key, m.To, RegistrationStatus{State: StateReady}))
+		}
+		if _, err := n.finishMoves(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyMap, err = c.registry.KeyMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads, avg, err := c.clusterLoads(keyMap, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if rel := loads[node].relativeTo(avg); rel > 1+LoadImbalanceThreshold {
+			t.Errorf("node %s: got load %v of average (%v keys), want at most %v", node, rel, loads[node].keys, 1+LoadImbalanceThreshold)
+		}
+	}
+}
+
+// Test that moves started by a balancer leader are finished by the next
+// leader.
+func TestNode_FinishMoves_NewLeader(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	n1 := NewNode("n1:80", b, NoopProvider{})
+	n2 := NewNode("n2:80", b, NoopProvider{})
+
+	nodes := []string{"n1:80", "n2:80"}
+	for _, node := range nodes {
+		must(t, b.SetDir(keyPathJoin(nodesPrefix, node), 0))
+	}
+	for i := 0; i < 4; i++ {
+		must(t, c.registry.add(fmt.Sprintf("k%d", i), "n1:80", RegistrationStatus{State: StateReady}, ReasonExisting))
+	}
+
+	keyMap, err := c.registry.KeyMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := n1.rebalanceLoad(c, keyMap, nodes, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Fatal("got no moves, want some")
+	}
+
+	// n1 stops being the leader before the moves finish, and n2 takes over.
+	moves, err := c.registry.moves()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moves) != moved {
+		t.Fatalf("got %d moves in the registry, want %d", len(moves), moved)
+	}
+	for key, m := range moves {
+		must(t, c.registry.SetStatus(key, m.To, RegistrationStatus{State: StateReady}))
+	}
+	if finished, err := n2.finishMoves(c); err != nil || finished != moved {
+		t.Errorf("got %d finished moves, %v, want %d", finished, err, moved)
+	}
+	for key := range moves {
+		if nodes, err := c.NodesForKey(key); err != nil || len(nodes) != 1 || nodes[0] != "n2:80" {
+			t.Errorf("key %q: got NodesForKey == %v, %v, want [n2:80]", key, nodes, err)
+		}
+	}
+	if moves, err := c.registry.moves(); err != nil || len(moves) != 0 {
+		t.Errorf("got %d moves in progress, %v, want none", len(moves), err)
+	}
+}
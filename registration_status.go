@@ -0,0 +1,142 @@
+package datad
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// A RegistrationState is the state of a key's data on a node that the key
+// is registered to.
+type RegistrationState string
+
+const (
+	// StatePending means that the key was registered to the node, but the
+	// node has not started fetching it yet.
+	StatePending RegistrationState = "pending"
+
+	// StateFetching means that the node is fetching the key for the first
+	// time.
+	StateFetching RegistrationState = "fetching"
+
+	// StateReady means that the node has the key's data (although it may be
+	// updating it).
+	StateReady RegistrationState = "ready"
+
+	// StateFailed means that the node failed to fetch the key and does not
+	// have its data.
+	StateFailed RegistrationState = "failed"
+)
+
+// A RegistrationReason is why the node side of a registration (the key
+// listed under the node, which the node watches) was last written. The node
+// fetches or updates the key when its registration is written, unless the
+// reason is ReasonExisting.
+type RegistrationReason string
+
+const (
+	// ReasonAssigned means that the key was registered to the node so that
+	// the node would fetch it. Registrations written before reasons existed
+	// (with an empty reason) are treated as assigned.
+	ReasonAssigned RegistrationReason = "assigned"
+
+	// ReasonExisting means that the node registered the key itself because
+	// it already had the key's data.
+	ReasonExisting RegistrationReason = "existing"
+
+	// ReasonUpdate means that an update of the key was requested (see
+	// Registry.RequestUpdate).
+	ReasonUpdate RegistrationReason = "update"
+)
+
+// A RegistrationStatus describes the state of a key's data on a node that
+// the key is registered to. It is written by the node as it updates the key,
+// and it is stored in the registry alongside the registration.
+type RegistrationStatus struct {
+	State RegistrationState `json:"state"`
+
+	// Error is the error from the node's last failed update of the key, if
+	// its last update failed. A key whose update failed is still StateReady
+	// if the node has older data for it.
+	Error string `json:"error,omitempty"`
+
+	// Time is when the status was written.
+	Time time.Time `json:"time"`
+}
+
+// Ready reports whether the node has the key's data.
+func (s RegistrationStatus) Ready() bool { return s.State == StateReady }
+
+// Busy reports whether the node is going to fetch (or is fetching) the key
+// for the first time.
+func (s RegistrationStatus) Busy() bool { return s.State == StatePending || s.State == StateFetching }
+
+func (s RegistrationStatus) encode() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// parseRegistrationStatus parses the value of the key side of a
+// registration. Registrations written before statuses existed have empty
+// values, and their nodes are assumed to have the key's data.
+func parseRegistrationStatus(v string) (RegistrationStatus, error) {
+	if v == "" {
+		return RegistrationStatus{State: StateReady}, nil
+	}
+	var s RegistrationStatus
+	err := json.Unmarshal([]byte(v), &s)
+	return s, err
+}
+
+// Status returns the status of the registration of key to node. If key is
+// not registered to node, ErrKeyNotExist is returned.
+func (r *Registry) Status(key, node string) (RegistrationStatus, error) {
+	v, err := r.backend.Get(registrationSides(key, node)[0])
+	if err != nil {
+		return RegistrationStatus{}, err
+	}
+	return parseRegistrationStatus(v)
+}
+
+// Statuses returns the status of key's registration to each node that it is
+// registered to.
+func (r *Registry) Statuses(key string) (map[string]RegistrationStatus, error) {
+	nodes, err := r.NodesForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]RegistrationStatus, len(nodes))
+	for _, node := range nodes {
+		s, err := r.Status(key, node)
+		if err == ErrKeyNotExist {
+			// Concurrently deregistered.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		statuses[node] = s
+	}
+	return statuses, nil
+}
+
+// SetStatus sets the status of the registration of key to node. If status.Time
+// is zero, the current time is used. If key is not registered to node,
+// ErrKeyNotExist is returned (and key is not registered).
+func (r *Registry) SetStatus(key, node string, status RegistrationStatus) error {
+	if status.Time.IsZero() {
+		status.Time = time.Now()
+	}
+	bkey := registrationSides(key, node)[0]
+	for {
+		_, index, err := r.backend.GetIndex(bkey)
+		if err != nil {
+			return err
+		}
+		_, err = r.backend.CompareAndSwap(bkey, status.encode(), 0, index)
+		if err != ErrCompareFailed {
+			return err
+		}
+	}
+}
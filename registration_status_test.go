@@ -0,0 +1,42 @@
+package datad
+
+import "testing"
+
+func TestRegistry_Status(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	if _, err := r.Status("k", "n"); err != ErrKeyNotExist {
+		t.Errorf("got Status error %v, want ErrKeyNotExist", err)
+	}
+	if err := r.SetStatus("k", "n", RegistrationStatus{State: StateReady}); err != ErrKeyNotExist {
+		t.Errorf("got SetStatus error %v, want ErrKeyNotExist", err)
+	}
+	if nodes, _ := r.NodesForKey("k"); len(nodes) != 0 {
+		t.Errorf("SetStatus registered key to nodes %v", nodes)
+	}
+
+	must(t, r.Add("k", "n"))
+	if s, err := r.Status("k", "n"); err != nil {
+		t.Fatal(err)
+	} else if s.State != StatePending || s.Time.IsZero() {
+		t.Errorf("got Status == %+v after Add, want pending with time", s)
+	}
+
+	must(t, r.SetStatus("k", "n", RegistrationStatus{State: StateFailed, Error: "x"}))
+	if s, err := r.Status("k", "n"); err != nil {
+		t.Fatal(err)
+	} else if s.State != StateFailed || s.Error != "x" || s.Time.IsZero() {
+		t.Errorf("got Status == %+v, want failed with error and time", s)
+	}
+
+	// Registrations written before statuses existed are ready.
+	must(t, b.Set(registrationSides("k", "n2")[0], ""))
+	statuses, err := r.Statuses("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses["n"].State != StateFailed || statuses["n2"].State != StateReady {
+		t.Errorf("got Statuses == %+v, want n failed and n2 ready", statuses)
+	}
+}
@@ -1,6 +1,7 @@
 package datad
 
 import (
+	"fmt"
 	"log"
 	"strings"
 	"time"
@@ -8,6 +9,11 @@ import (
 
 var RegistrationTTL = 60 * time.Second
 
+// RegistrationLockTTL is the time-to-live of the lock that AddIfUnregistered
+// holds while it registers a key. It only matters if the process holding the
+// lock dies before releasing it.
+var RegistrationLockTTL = 10 * time.Second
+
 // A Registry contains a bidirectional mapping between data keys and nodes: (1)
 // for a given data key, a list of cluster nodes that have the underlying data
 // on disk; and (2) for a given node, a list of data keys that it should
@@ -50,7 +56,7 @@ func (r *Registry) KeyMap() (map[string][]string, error) {
 		// node.
 		parts := strings.Split(bk, suffix)
 		if len(parts) != 2 {
-			log.Printf("In KeyMap, skipping bad (unparseable) backend key in registry: %q.", bk)
+			log.Printf("In KeyMap, skipping bad (unparseable) backend key in registry: %q (Registry.Repair removes such keys).", bk)
 			continue
 		}
 
@@ -67,38 +73,279 @@ func (r *Registry) KeyMap() (map[string][]string, error) {
 	return km, nil
 }
 
+// Add registers key to node, with the status StatePending (until the node
+// fetches the key and updates its status). If key is already registered to
+// node, Add does nothing (it does not overwrite the existing registration),
+// except to restore either side of the registration if it is missing.
+//
+// A registration has two sides: the node listed under the key, and the key
+// listed under the node. If the backend is a TxnBackend, both sides are
+// written atomically. Otherwise they are written one after the other, and if
+// the second write fails, Add deletes the first side again; if that fails
+// too, Add returns a *PartialRegistrationError.
 func (r *Registry) Add(key, node string) error {
-	err := r.backend.Set(nodesForKeyDir(key)+"/"+node, "")
-	if err != nil {
-		return err
+	return r.add(key, node, RegistrationStatus{State: StatePending}, ReasonAssigned)
+}
+
+// add is like Add, but it registers key with the given status and reason (if
+// key is not already registered).
+func (r *Registry) add(key, node string, status RegistrationStatus, reason RegistrationReason) error {
+	if status.Time.IsZero() {
+		status.Time = time.Now()
 	}
+	sides := registrationSides(key, node)
+	values := [2]string{status.encode(), string(reason)}
 
-	err = r.backend.Set(keysForNodeDir(node)+"/"+key, "")
-	if err != nil {
-		return err
+	if tb, ok := r.backend.(TxnBackend); ok {
+		err := tb.Txn([]TxnOp{{Type: TxnCreate, Key: sides[0], Value: values[0]}, {Type: TxnCreate, Key: sides[1], Value: values[1]}})
+		if err != ErrKeyExists {
+			return err
+		}
+
+		// At least one side exists, so create only the missing side (if
+		// any).
+		for i, side := range sides {
+			if _, err := r.backend.Create(side, values[i], 0); err != nil && err != ErrKeyExists {
+				return err
+			}
+		}
+		return nil
 	}
 
+	var created string
+	for i, side := range sides {
+		_, err := r.backend.Create(side, values[i], 0)
+		if err == ErrKeyExists {
+			continue
+		} else if err != nil {
+			if created != "" {
+				if undoErr := r.backend.Delete(created); undoErr != nil {
+					return &PartialRegistrationError{Op: "add", Key: key, Node: node, Written: created, Err: err, UndoErr: undoErr}
+				}
+			}
+			return err
+		}
+		created = side
+	}
 	return nil
 }
 
-func (r *Registry) Remove(key, node string) error {
-	err := r.backend.Delete(nodesForKeyDir(key) + "/" + node)
+// registryBatchSize is the maximum number of keys that AddKeys registers in a
+// single transaction. (Each key takes 2 operations, and etcd allows 128
+// operations per transaction by default.)
+const registryBatchSize = 50
+
+// AddKeys registers each of keys to node with the given status and reason
+// (e.g., StateReady and ReasonExisting for keys whose data node already has).
+// Keys that are already registered to node are left as they are, as with
+// Add. If the backend is a TxnBackend, the keys are registered in batches
+// with as few transactions as possible; otherwise they are registered one at
+// a time.
+func (r *Registry) AddKeys(node string, keys []string, status RegistrationStatus, reason RegistrationReason) error {
+	if status.Time.IsZero() {
+		status.Time = time.Now()
+	}
+
+	tb, ok := r.backend.(TxnBackend)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > registryBatchSize {
+			batch = batch[:registryBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		if ok {
+			ops := make([]TxnOp, 0, 2*len(batch))
+			for _, key := range batch {
+				sides := registrationSides(key, node)
+				ops = append(ops, TxnOp{Type: TxnCreate, Key: sides[0], Value: status.encode()}, TxnOp{Type: TxnCreate, Key: sides[1], Value: string(reason)})
+			}
+			err := tb.Txn(ops)
+			if err == nil {
+				continue
+			} else if err != ErrKeyExists {
+				return err
+			}
+			// Some of the keys are already registered, so register the
+			// batch's keys one at a time.
+		}
+		for _, key := range batch {
+			if err := r.add(key, node, status, reason); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddIfUnregistered registers key to node only if key is not registered to
+// any nodes, and returns the nodes that key is registered to. Concurrent calls
+// for the same key register at most one node: while one caller registers the
+// key, the others return the node that it chose.
+func (r *Registry) AddIfUnregistered(key, node string) (nodes []string, err error) {
+	return r.AddReplicas(key, []string{node}, 1)
+}
+
+// AddReplicas registers key to nodes from candidates (in order, skipping
+// nodes that key is already registered to) until key is registered to at
+// least replicas nodes or candidates are exhausted. It returns the nodes that
+// key is registered to. Concurrent calls for the same key do not register it
+// to more nodes than needed: while one caller registers the key, the others
+// return the nodes that it chose.
+func (r *Registry) AddReplicas(key string, candidates []string, replicas int) (nodes []string, err error) {
+	nodes, err = r.NodesForKey(key)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	add := chooseReplicas(nodes, candidates, replicas)
+	if len(add) == 0 {
+		return nodes, nil
+	}
+
+	lockKey := keyPathJoin(registryPrefix, keysPrefix, key, keyLockFile)
+	lockValue := strings.Join(append(nodes, add...), ",")
+	lockIndex, err := r.backend.Create(lockKey, lockValue, uint64(RegistrationLockTTL/time.Second))
+	if err == ErrKeyExists {
+		// Another caller is registering key, so use the nodes it chose.
+		holder, err := r.backend.Get(lockKey)
+		if err == ErrKeyNotExist {
+			// It finished (or its lock expired), so check again.
+			return r.AddReplicas(key, candidates, replicas)
+		} else if err != nil {
+			return nil, err
+		}
+		return strings.Split(holder, ","), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Check again, since key might have been registered before the lock was
+	// acquired.
+	nodes, err = r.NodesForKey(key)
+	if err == nil {
+		for _, node := range chooseReplicas(nodes, candidates, replicas) {
+			if err = r.Add(key, node); err != nil {
+				break
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if err := r.backend.CompareAndDelete(lockKey, lockIndex); err != nil && err != ErrKeyNotExist {
+		log.Printf("Failed to release registration lock for key %q: %s.", key, err)
 	}
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
 
-	err = r.backend.Delete(keysForNodeDir(node) + "/" + key)
+// RequestUpdate modifies the existing registration of key to node, which
+// signals node (which watches its registrations) to update key from its
+// data source. If key is not registered to node, ErrKeyNotExist is returned.
+func (r *Registry) RequestUpdate(key, node string) error {
+	bkey := registrationSides(key, node)[1]
+	_, index, err := r.backend.GetIndex(bkey)
 	if err != nil {
 		return err
 	}
+	_, err = r.backend.CompareAndSwap(bkey, string(ReasonUpdate), 0, index)
+	return err
+}
+
+// Remove deregisters key from node. It only removes the registration that
+// it observed: if the registration is concurrently modified (e.g., by
+// RequestUpdate), ErrCompareFailed is returned. If only one side of the
+// registration exists, that side is removed; if neither does, ErrKeyNotExist
+// is returned.
+//
+// As with Add, both sides are removed atomically if the backend is a
+// TxnBackend. Otherwise, if removing the second side fails, Remove restores
+// the first side; if that fails too, Remove returns a
+// *PartialRegistrationError.
+func (r *Registry) Remove(key, node string) error {
+	var ops []TxnOp
+	var values []string
+	for _, side := range registrationSides(key, node) {
+		v, index, err := r.backend.GetIndex(side)
+		if err == ErrKeyNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		ops = append(ops, TxnOp{Type: TxnCompareAndDelete, Key: side, PrevIndex: index})
+		values = append(values, v)
+	}
+	if len(ops) == 0 {
+		return ErrKeyNotExist
+	}
 
+	if tb, ok := r.backend.(TxnBackend); ok {
+		return tb.Txn(ops)
+	}
+
+	for i, op := range ops {
+		if err := r.backend.CompareAndDelete(op.Key, op.PrevIndex); err != nil {
+			if i > 0 {
+				if _, undoErr := r.backend.Create(ops[0].Key, values[0], 0); undoErr != nil {
+					return &PartialRegistrationError{Op: "remove", Key: key, Node: node, Written: ops[0].Key, Err: err, UndoErr: undoErr}
+				}
+			}
+			return err
+		}
+	}
 	return nil
 }
 
+// deleteIfUnregistered removes key from the registry (so that KeyMap no
+// longer lists it) if it is not registered to any nodes. A node registered
+// to key concurrently may be left with only its side of the registration,
+// which Repair fixes.
+func (r *Registry) deleteIfUnregistered(key string) error {
+	nodes, err := r.NodesForKey(key)
+	if err != nil || len(nodes) > 0 {
+		return err
+	}
+	err = r.backend.DeleteDir(nodesForKeyDir(key))
+	if err == ErrKeyNotExist {
+		return nil
+	}
+	return err
+}
+
+// A PartialRegistrationError is returned by Registry.Add and Registry.Remove
+// when only one side of a registration was written (on a backend that is not
+// a TxnBackend) and the write could not be undone. The registry is
+// inconsistent until the registration is added or removed again.
+type PartialRegistrationError struct {
+	Op        string // "add" or "remove"
+	Key, Node string
+
+	// Written is the backend key of the side that was written (created by
+	// Add, or deleted by Remove).
+	Written string
+
+	Err     error // the error writing the other side
+	UndoErr error // the error undoing the write to Written
+}
+
+func (e *PartialRegistrationError) Error() string {
+	return fmt.Sprintf("registry %s of key %q on node %q only wrote %s: %s (undo failed: %s)", e.Op, e.Key, e.Node, e.Written, e.Err, e.UndoErr)
+}
+
+// registrationSides returns the backend keys of the two sides of the
+// registration of key to node: the node listed under the key, and the key
+// listed under the node.
+func registrationSides(key, node string) [2]string {
+	return [2]string{nodesForKeyDir(key) + "/" + node, keysForNodeDir(node) + "/" + key}
+}
+
 const (
 	registryPrefix = "registry"
 	keyNodesSubdir = "$$nodes"
 	nodeKeysSubdir = "$$keys"
+
+	// keyLockFile is held by AddIfUnregistered while it registers a key.
+	keyLockFile = "$$lock"
 )
 
 func nodesForKeyDir(key string) string {
@@ -108,11 +355,3 @@ func nodesForKeyDir(key string) string {
 func keysForNodeDir(node string) string {
 	return keyPathJoin(registryPrefix, nodesPrefix, node, nodeKeysSubdir)
 }
-
-func keyBucket(key string, n int) int {
-	var x uint8
-	for i := 0; i < len(key); i++ {
-		x += key[i]
-	}
-	return int(x) % n
-}
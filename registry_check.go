@@ -0,0 +1,168 @@
+package datad
+
+import "strings"
+
+// A Registration is the registration of a data key to a node.
+type Registration struct {
+	Key, Node string
+}
+
+// A CheckReport describes the inconsistencies that Registry.Check found in
+// the registry.
+type CheckReport struct {
+	// MissingNodeSide lists registrations whose key side (the node listed
+	// under the key) exists but whose node side (the key listed under the
+	// node) does not. Clients route requests for the key to the node, but
+	// the node doesn't know to fetch it.
+	MissingNodeSide []Registration
+
+	// MissingKeySide lists registrations whose node side exists but whose
+	// key side does not. The node fetches the key, but clients never route
+	// requests for it to the node.
+	MissingKeySide []Registration
+
+	// DeadNode lists registrations (complete or not) to nodes that are not
+	// members of the cluster.
+	DeadNode []Registration
+
+	// Unparseable lists the backend keys in the registry that are not part
+	// of any registration.
+	Unparseable []string
+}
+
+// OK reports whether no inconsistencies were found.
+func (r *CheckReport) OK() bool {
+	return len(r.MissingNodeSide) == 0 && len(r.MissingKeySide) == 0 && len(r.DeadNode) == 0 && len(r.Unparseable) == 0
+}
+
+// Check scans both sides of the registry (the nodes listed under each key,
+// and the keys listed under each node) and reports the inconsistencies it
+// finds. It does not modify the registry.
+//
+// Registrations that are being added or removed by a concurrent call to Add
+// or Remove may be reported as missing a side if the backend is not a
+// TxnBackend.
+func (r *Registry) Check() (*CheckReport, error) {
+	members, err := r.backend.List(nodesPrefix, false)
+	if err != nil {
+		return nil, err
+	}
+	isMember := make(map[string]bool, len(members))
+	for _, node := range members {
+		isMember[node] = true
+	}
+
+	var report CheckReport
+
+	// Map each registration to which of its sides exist.
+	const keySide, nodeSide = 1, 2
+	sides := make(map[Registration]int)
+	var regs []Registration
+	add := func(reg Registration, side int) {
+		if sides[reg] == 0 {
+			regs = append(regs, reg)
+		}
+		sides[reg] |= side
+	}
+
+	dataDir := keyPathJoin(registryPrefix, keysPrefix)
+	bkeys, err := r.backend.ListKeys(dataDir, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, bk := range bkeys {
+		if reg, ok := parseKeySide(bk); ok {
+			add(reg, keySide)
+		} else if !strings.HasSuffix(bk, "/"+keyLockFile) {
+			report.Unparseable = append(report.Unparseable, keyPathJoin(dataDir, bk))
+		}
+	}
+
+	nodesDir := keyPathJoin(registryPrefix, nodesPrefix)
+	bkeys, err = r.backend.ListKeys(nodesDir, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, bk := range bkeys {
+		if reg, ok := parseNodeSide(bk); ok {
+			add(reg, nodeSide)
+		} else {
+			report.Unparseable = append(report.Unparseable, keyPathJoin(nodesDir, bk))
+		}
+	}
+
+	for _, reg := range regs {
+		if !isMember[reg.Node] {
+			report.DeadNode = append(report.DeadNode, reg)
+		}
+		switch sides[reg] {
+		case keySide:
+			report.MissingNodeSide = append(report.MissingNodeSide, reg)
+		case nodeSide:
+			report.MissingKeySide = append(report.MissingKeySide, reg)
+		}
+	}
+	return &report, nil
+}
+
+// Repair checks the registry (as Check does) and fixes the inconsistencies
+// it finds:
+//
+//   - registrations to nodes that are not members of the cluster are removed
+//     (a node whose membership lapsed re-registers its keys when it
+//     restarts);
+//   - other registrations that are missing a side have it restored; and
+//   - unparseable backend keys are deleted.
+//
+// It returns the report of the inconsistencies found before they were fixed.
+// Registrations that were concurrently modified or removed are skipped.
+func (r *Registry) Repair() (*CheckReport, error) {
+	report, err := r.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	dead := make(map[Registration]bool, len(report.DeadNode))
+	for _, reg := range report.DeadNode {
+		dead[reg] = true
+		if err := r.Remove(reg.Key, reg.Node); err != nil && err != ErrKeyNotExist && err != ErrCompareFailed {
+			return report, err
+		}
+	}
+	for _, regs := range [][]Registration{report.MissingNodeSide, report.MissingKeySide} {
+		for _, reg := range regs {
+			if dead[reg] {
+				continue
+			}
+			if err := r.Add(reg.Key, reg.Node); err != nil {
+				return report, err
+			}
+		}
+	}
+	for _, bk := range report.Unparseable {
+		if err := r.backend.Delete(bk); err != nil && err != ErrKeyNotExist {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// parseKeySide parses a backend key of the form "KEY/$$nodes/NODE" (relative
+// to the registry's data directory).
+func parseKeySide(bk string) (Registration, bool) {
+	parts := strings.Split(bk, "/"+keyNodesSubdir+"/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return Registration{}, false
+	}
+	return Registration{Key: parts[0], Node: parts[1]}, true
+}
+
+// parseNodeSide parses a backend key of the form "NODE/$$keys/KEY" (relative
+// to the registry's nodes directory).
+func parseNodeSide(bk string) (Registration, bool) {
+	parts := strings.SplitN(bk, "/"+nodeKeysSubdir+"/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], "/") {
+		return Registration{}, false
+	}
+	return Registration{Key: parts[1], Node: parts[0]}, true
+}
@@ -0,0 +1,73 @@
+package datad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry_Check(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, "n1"), 0))
+	must(t, b.SetDir(keyPathJoin(nodesPrefix, "n2"), 0))
+
+	must(t, r.Add("ok", "n1"))
+	must(t, r.Add("a/b", "n2"))
+	must(t, r.Add("dead", "n3"))
+	must(t, r.Add("nokey", "n1"))
+	must(t, b.Delete(registrationSides("nokey", "n1")[0]))
+	must(t, r.Add("nonode", "n2"))
+	must(t, b.Delete(registrationSides("nonode", "n2")[1]))
+	must(t, b.Set(keyPathJoin(registryPrefix, keysPrefix, "bad"), ""))
+	must(t, b.Set(keyPathJoin(registryPrefix, nodesPrefix, "n1", "bad"), ""))
+
+	// Registration locks are not unparseable.
+	_, err := b.Create(keyPathJoin(registryPrefix, keysPrefix, "locked", keyLockFile), "n1", 0)
+	must(t, err)
+
+	report, err := r.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CheckReport{
+		MissingNodeSide: []Registration{{"nonode", "n2"}},
+		MissingKeySide:  []Registration{{"nokey", "n1"}},
+		DeadNode:        []Registration{{"dead", "n3"}},
+		Unparseable:     []string{"/registry/data/bad", "/registry/nodes/n1/bad"},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %+v, want %+v", report, want)
+	}
+	if report.OK() {
+		t.Error("got report.OK() == true, want false")
+	}
+
+	if report, err := r.Repair(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(report, want) {
+		t.Errorf("got Repair report %+v, want %+v", report, want)
+	}
+
+	report, err = r.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("got report %+v after Repair, want no inconsistencies", report)
+	}
+	km, err := r.KeyMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKM := map[string][]string{"ok": {"n1"}, "a/b": {"n2"}, "nokey": {"n1"}, "nonode": {"n2"}}
+	for key, nodes := range km {
+		if nodes == nil {
+			// KeyMap reports keys whose registrations were all removed.
+			delete(km, key)
+		}
+	}
+	if !reflect.DeepEqual(km, wantKM) {
+		t.Errorf("got KeyMap %v after Repair, want %v", km, wantKM)
+	}
+}
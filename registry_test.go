@@ -1,6 +1,8 @@
 package datad
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
@@ -9,90 +11,340 @@ import (
 
 func TestRegistry(t *testing.T) {
 	withEtcd(t, func(ec *etcd_client.Client) {
-		b := NewEtcdBackend("/", ec)
-		r := NewRegistry(b)
+		testRegistry(t, NewRegistry(NewEtcdBackend("/", ec)))
+	})
+}
 
-		keys, err := r.KeysForNode("n")
-		if err != nil {
-			t.Fatal(err)
-		}
-		if len(keys) != 0 {
-			t.Errorf("got KeysForNode == %v, want empty", keys)
-		}
+func TestRegistry_MemoryBackend(t *testing.T) {
+	testRegistry(t, NewRegistry(NewMemoryBackend()))
+}
 
-		nodes, err := r.NodesForKey("k")
-		if err != nil {
-			t.Fatal(err)
-		}
-		if len(nodes) != 0 {
-			t.Errorf("got NodesForKey == %v, want empty", nodes)
-		}
+func testRegistry(t *testing.T, r *Registry) {
+	keys, err := r.KeysForNode("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got KeysForNode == %v, want empty", keys)
+	}
 
-		// Add some mappings.
-		err = r.Add("k", "n")
-		if err != nil {
-			t.Fatal(err)
-		}
-		err = r.Add("l/m", "n")
-		if err != nil {
-			t.Fatal(err)
-		}
+	nodes, err := r.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("got NodesForKey == %v, want empty", nodes)
+	}
 
-		// Test that the mappings are set.
-		keys, err = r.KeysForNode("n")
-		if err != nil {
-			t.Fatal(err)
-		}
-		if want := []string{"k", "l/m"}; !reflect.DeepEqual(keys, want) {
-			t.Errorf("got KeysForNode == %v, want %v", keys, want)
-		}
+	// Add some mappings.
+	err = r.Add("k", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Add("l/m", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		nodes, err = r.NodesForKey("k")
-		if err != nil {
-			t.Fatal(err)
-		}
-		if want := []string{"n"}; !reflect.DeepEqual(nodes, want) {
-			t.Errorf("got NodesForKey == %v, want %v", nodes, want)
-		}
+	// Test that the mappings are set.
+	keys, err = r.KeysForNode("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"k", "l/m"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got KeysForNode == %v, want %v", keys, want)
+	}
 
-		nodes, err = r.NodesForKey("l/m")
-		if err != nil {
-			t.Fatal(err)
-		}
-		if want := []string{"n"}; !reflect.DeepEqual(nodes, want) {
-			t.Errorf("got NodesForKey == %v, want %v", nodes, want)
-		}
+	nodes, err = r.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"n"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
 
-		// Remove the mapping for l/m.
-		err = r.Remove("l/m", "n")
-		if err != nil {
-			t.Fatal(err)
-		}
+	nodes, err = r.NodesForKey("l/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"n"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
 
-		// Test that the mapping was removed.
+	// Remove the mapping for l/m.
+	err = r.Remove("l/m", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		keys, err = r.KeysForNode("n")
-		if err != nil {
-			t.Fatal(err)
+	// Test that the mapping was removed.
+
+	keys, err = r.KeysForNode("n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"k"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got KeysForNode == %v, want %v", keys, want)
+	}
+
+	keyMap, err := r.KeyMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"k": []string{"n"}, "l/m": nil}; !reflect.DeepEqual(keyMap, want) {
+		t.Errorf("got KeyMap == %v, want %v", keyMap, want)
+	}
+
+	nodes, err = r.NodesForKey("l/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 0 {
+		t.Errorf("got NodesForKey == %v, want empty", nodes)
+	}
+}
+
+func TestRegistry_AddIfUnregistered(t *testing.T) {
+	r := NewRegistry(NewMemoryBackend())
+
+	// Register the same key concurrently to many nodes.
+	const n = 10
+	results := make(chan []string, n)
+	for i := 0; i < n; i++ {
+		go func(node string) {
+			nodes, err := r.AddIfUnregistered("k", node)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- nodes
+		}(fmt.Sprintf("n%d", i))
+	}
+	var want []string
+	for i := 0; i < n; i++ {
+		nodes := <-results
+		if len(nodes) != 1 {
+			t.Fatalf("got AddIfUnregistered == %v, want 1 node", nodes)
 		}
-		if want := []string{"k"}; !reflect.DeepEqual(keys, want) {
-			t.Errorf("got KeysForNode == %v, want %v", keys, want)
+		if want == nil {
+			want = nodes
+		} else if !reflect.DeepEqual(nodes, want) {
+			t.Errorf("got AddIfUnregistered == %v, want %v (same as other callers)", nodes, want)
 		}
+	}
 
-		keyMap, err := r.KeyMap()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if want := map[string][]string{"k": []string{"n"}, "l/m": nil}; !reflect.DeepEqual(keyMap, want) {
-			t.Errorf("got KeyMap == %v, want %v", keyMap, want)
+	nodes, err := r.NodesForKey("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got NodesForKey == %v, want %v", nodes, want)
+	}
+
+	// Now that the key is registered, it is not registered to other nodes.
+	nodes, err = r.AddIfUnregistered("k", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got AddIfUnregistered == %v, want %v", nodes, want)
+	}
+}
+
+func TestRegistry_RequestUpdate(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+
+	if err := r.RequestUpdate("k", "n"); err != ErrKeyNotExist {
+		t.Errorf("got RequestUpdate error %v, want ErrKeyNotExist", err)
+	}
+
+	must(t, r.Add("k", "n"))
+	_, index, err := b.GetIndex(keysForNodeDir("n") + "/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	must(t, r.RequestUpdate("k", "n"))
+	_, index2, err := b.GetIndex(keysForNodeDir("n") + "/k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index2 <= index {
+		t.Errorf("got index %d after RequestUpdate, want > %d", index2, index)
+	}
+
+	// Adding an existing registration is a no-op.
+	must(t, r.Add("k", "n"))
+	if _, index3, _ := b.GetIndex(keysForNodeDir("n") + "/k"); index3 != index2 {
+		t.Errorf("got index %d after re-adding, want unchanged %d", index3, index2)
+	}
+}
+
+var errTestBackend = errors.New("test backend error")
+
+// nonTxnBackend hides a backend's Txn method (to test the Registry's fallback
+// for backends that don't support transactions) and fails writes to certain
+// keys.
+type nonTxnBackend struct {
+	Backend
+	failCreate, failDelete string
+}
+
+func (b *nonTxnBackend) Create(key, value string, ttl uint64) (uint64, error) {
+	if key == b.failCreate {
+		return 0, errTestBackend
+	}
+	return b.Backend.Create(key, value, ttl)
+}
+
+func (b *nonTxnBackend) Delete(key string) error {
+	if key == b.failDelete {
+		return errTestBackend
+	}
+	return b.Backend.Delete(key)
+}
+
+func (b *nonTxnBackend) CompareAndDelete(key string, prevIndex uint64) error {
+	if key == b.failDelete {
+		return errTestBackend
+	}
+	return b.Backend.CompareAndDelete(key, prevIndex)
+}
+
+func TestRegistry_NonTxnBackend(t *testing.T) {
+	mb := NewMemoryBackend()
+	b := &nonTxnBackend{Backend: mb}
+	r := NewRegistry(b)
+
+	testRegistry(t, r)
+
+	// Use a key and node that testRegistry didn't.
+	sides := registrationSides("pk", "pn")
+	keySide, nodeSide := sides[0], sides[1]
+	exists := func(bkey string) bool {
+		_, err := mb.Get(bkey)
+		return err == nil
+	}
+
+	// A failed Add is undone.
+	b.failCreate = nodeSide
+	if err := r.Add("pk", "pn"); err != errTestBackend {
+		t.Errorf("got Add error %v, want %v", err, errTestBackend)
+	}
+	if exists(keySide) {
+		t.Error("key side of failed Add was not undone")
+	}
+
+	// If it can't be undone, a PartialRegistrationError is returned.
+	b.failDelete = keySide
+	err := r.Add("pk", "pn")
+	if perr, ok := err.(*PartialRegistrationError); !ok || perr.Written != keySide || perr.Err != errTestBackend {
+		t.Errorf("got Add error %v, want PartialRegistrationError for %s", err, keySide)
+	}
+
+	// Adding again repairs the registration.
+	b.failCreate, b.failDelete = "", ""
+	must(t, r.Add("pk", "pn"))
+	if !exists(keySide) || !exists(nodeSide) {
+		t.Error("Add did not repair partial registration")
+	}
+
+	// A failed Remove is undone.
+	b.failDelete = nodeSide
+	if err := r.Remove("pk", "pn"); err != errTestBackend {
+		t.Errorf("got Remove error %v, want %v", err, errTestBackend)
+	}
+	if !exists(keySide) {
+		t.Error("key side of failed Remove was not restored")
+	}
+
+	b.failCreate = keySide
+	err = r.Remove("pk", "pn")
+	if perr, ok := err.(*PartialRegistrationError); !ok || perr.Written != keySide || perr.Err != errTestBackend {
+		t.Errorf("got Remove error %v, want PartialRegistrationError for %s", err, keySide)
+	}
+
+	// Removing again removes the remaining side.
+	b.failCreate, b.failDelete = "", ""
+	must(t, r.Remove("pk", "pn"))
+	if exists(keySide) || exists(nodeSide) {
+		t.Error("Remove did not remove partial registration")
+	}
+	if err := r.Remove("pk", "pn"); err != ErrKeyNotExist {
+		t.Errorf("got Remove error %v, want ErrKeyNotExist", err)
+	}
+}
+
+func TestRegistry_RepairPartial(t *testing.T) {
+	b := NewMemoryBackend()
+	r := NewRegistry(b)
+	sides := registrationSides("k", "n")
+
+	// Add restores a missing side.
+	_, err := b.Create(sides[1], "", 0)
+	must(t, err)
+	must(t, r.Add("k", "n"))
+	if nodes, err := r.NodesForKey("k"); err != nil || !reflect.DeepEqual(nodes, []string{"n"}) {
+		t.Errorf("got NodesForKey == %v, %v, want [n]", nodes, err)
+	}
+
+	// Remove removes a lone side.
+	must(t, b.Delete(sides[1]))
+	must(t, r.Remove("k", "n"))
+	if _, err := b.Get(sides[0]); err != ErrKeyNotExist {
+		t.Errorf("got Get error %v, want ErrKeyNotExist", err)
+	}
+}
+
+func TestRegistry_AddReplicas(t *testing.T) {
+	r := NewRegistry(NewMemoryBackend())
+
+	must(t, r.Add("k", "a"))
+	nodes, err := r.AddReplicas("k", []string{"a", "b", "c", "d"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got AddReplicas == %v, want %v", nodes, want)
+	}
+
+	// Already enough replicas.
+	nodes, err = r.AddReplicas("k", []string{"d"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got AddReplicas == %v, want %v", nodes, want)
+	}
+}
+
+func TestRegistry_AddKeys(t *testing.T) {
+	for _, b := range []Backend{NewMemoryBackend(), &nonTxnBackend{Backend: NewMemoryBackend()}} {
+		r := NewRegistry(b)
+
+		var keys []string
+		for i := 0; i < 2*registryBatchSize+10; i++ {
+			keys = append(keys, fmt.Sprintf("k%d", i))
 		}
+		must(t, r.Add(keys[registryBatchSize+1], "n"))
+
+		must(t, r.AddKeys("n", keys, RegistrationStatus{State: StateReady}, ReasonExisting))
 
-		nodes, err = r.NodesForKey("l/m")
+		got, err := r.KeysForNode("n")
 		if err != nil {
 			t.Fatal(err)
 		}
-		if len(nodes) != 0 {
-			t.Errorf("got NodesForKey == %v, want empty", nodes)
+		if len(got) != len(keys) {
+			t.Errorf("%T: got %d keys for node, want %d", b, len(got), len(keys))
 		}
-	})
+		for i, key := range keys {
+			want := StateReady
+			if i == registryBatchSize+1 {
+				// Existing registrations are left as they are.
+				want = StatePending
+			}
+			if status, err := r.Status(key, "n"); err != nil || status.State != want {
+				t.Errorf("%T: got status %+v, %v for key %q, want %s", b, status, err, key, want)
+			}
+		}
+	}
 }
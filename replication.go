@@ -0,0 +1,81 @@
+package datad
+
+import "strings"
+
+// A ReplicationPolicy determines the number of nodes that each key is
+// registered to (its replicas). Client.Update and the balancer register keys
+// to more nodes until they have at least that many replicas, each on a
+// distinct node (or until every node in the cluster holds the key). Keys
+// that have more replicas than the policy requires are left alone.
+//
+// The zero value registers each key to a single node.
+type ReplicationPolicy struct {
+	// Default is the number of replicas of keys that match none of Prefixes.
+	// Values less than 1 mean 1.
+	Default int
+
+	// Prefixes maps key prefixes to the number of replicas of keys that
+	// begin with them. If several prefixes match a key, the longest one is
+	// used. Leading slashes on keys and prefixes are ignored.
+	Prefixes map[string]int
+
+	// Pinned is the number of replicas of pinned keys (see Registry.Pin).
+	// If a pinned key would have more replicas if it weren't pinned, that
+	// number is used instead.
+	Pinned int
+
+	// Minimum is the number of nodes that must have each key's data. Nodes
+	// do not evict a key to free space (see Node.MaxBytes) if that would
+	// leave fewer than Minimum nodes with its data. Unlike the number of
+	// replicas, Minimum may be 0, which lets nodes evict the only copy of a
+	// key (which is fetched again when it is next requested).
+	Minimum int
+}
+
+// Replicas returns the number of replicas that key should have.
+func (p ReplicationPolicy) Replicas(key string) int {
+	key = unslash(key)
+	replicas, matched := p.Default, -1
+	for prefix, n := range p.Prefixes {
+		prefix = unslash(prefix)
+		if strings.HasPrefix(key, prefix) && len(prefix) > matched {
+			replicas, matched = n, len(prefix)
+		}
+	}
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
+
+// replicas returns the number of replicas of key, which is pinned if pinned
+// is true.
+func (p ReplicationPolicy) replicas(key string, pinned bool) int {
+	replicas := p.Replicas(key)
+	if pinned && p.Pinned > replicas {
+		return p.Pinned
+	}
+	return replicas
+}
+
+// chooseReplicas returns the nodes from candidates (in order, as returned by
+// a Placement) that a key should be registered to so that it has at least
+// replicas replicas, given that it is already registered to the nodes in
+// registered.
+func chooseReplicas(registered, candidates []string, replicas int) []string {
+	isRegistered := make(map[string]bool, len(registered))
+	for _, node := range registered {
+		isRegistered[node] = true
+	}
+	var chosen []string
+	for _, node := range candidates {
+		if len(registered)+len(chosen) >= replicas {
+			break
+		}
+		if !isRegistered[node] {
+			chosen = append(chosen, node)
+			isRegistered[node] = true
+		}
+	}
+	return chosen
+}
@@ -0,0 +1,47 @@
+package datad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplicationPolicy_Replicas(t *testing.T) {
+	p := ReplicationPolicy{
+		Default:  2,
+		Prefixes: map[string]int{"/a": 3, "a/b": 5, "c": 0},
+	}
+	tests := map[string]int{
+		"x":     2,
+		"/a":    3,
+		"a/x":   3,
+		"/a/b":  5,
+		"a/b/c": 5,
+		"c":     1,
+	}
+	for key, want := range tests {
+		if got := p.Replicas(key); got != want {
+			t.Errorf("%q: got Replicas == %d, want %d", key, got, want)
+		}
+	}
+
+	if got := (ReplicationPolicy{}).Replicas("x"); got != 1 {
+		t.Errorf("got zero policy Replicas == %d, want 1", got)
+	}
+}
+
+func TestChooseReplicas(t *testing.T) {
+	candidates := []string{"a", "b", "c", "d"}
+
+	if got, want := chooseReplicas(nil, candidates, 2), candidates[:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got chooseReplicas == %v, want %v", got, want)
+	}
+	if got, want := chooseReplicas([]string{candidates[0]}, candidates, 3), candidates[1:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got chooseReplicas == %v, want %v", got, want)
+	}
+	if got := chooseReplicas([]string{"x", "y"}, candidates, 2); len(got) != 0 {
+		t.Errorf("got chooseReplicas == %v, want none", got)
+	}
+	if got := chooseReplicas(nil, candidates, 10); !reflect.DeepEqual(got, candidates) {
+		t.Errorf("got chooseReplicas == %v, want all candidates %v", got, candidates)
+	}
+}
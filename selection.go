@@ -0,0 +1,208 @@
+package datad
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Selector decides the order in which a KeyTransport tries the nodes that a
+// key is registered to (so that requests for a key can be spread across its
+// replicas).
+type Selector interface {
+	// Select returns nodes (the nodes that key is registered to) in the
+	// order that they should be tried for a request for key. nodes must not
+	// be modified.
+	Select(key string, nodes []string) []string
+}
+
+// A LatencyObserver is a Selector that is told the latency of each successful
+// request that a KeyTransport makes to a node.
+type LatencyObserver interface {
+	Selector
+
+	ObserveLatency(node string, latency time.Duration)
+}
+
+// OrderedSelector is a Selector that tries nodes in the order that they are
+// registered to the key. All requests for a key go to the same node unless it
+// fails.
+//
+// It is the default Selector of Clients.
+type OrderedSelector struct{}
+
+func (OrderedSelector) Select(key string, nodes []string) []string { return nodes }
+
+// RandomSelector is a Selector that tries nodes in a random order.
+type RandomSelector struct{}
+
+func (RandomSelector) Select(key string, nodes []string) []string {
+	selected := make([]string, len(nodes))
+	for i, j := range rand.Perm(len(nodes)) {
+		selected[i] = nodes[j]
+	}
+	return selected
+}
+
+// RoundRobinSelector is a Selector that rotates the first node tried for
+// each request through the nodes. Its zero value is ready to use.
+type RoundRobinSelector struct {
+	next uint64 // accessed atomically
+}
+
+func (s *RoundRobinSelector) Select(key string, nodes []string) []string {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	i := int((atomic.AddUint64(&s.next, 1) - 1) % uint64(len(nodes)))
+	return append(append([]string(nil), nodes[i:]...), nodes[:i]...)
+}
+
+// DefaultEWMADecay is the default value of EWMASelector.Decay.
+var DefaultEWMADecay = 0.3
+
+// EWMASelector is a Selector that tries the nodes with the lowest
+// exponentially weighted moving average latency first. Nodes with no
+// observed latency are tried before the others (so that their latency is
+// observed). Its zero value is ready to use.
+type EWMASelector struct {
+	// Decay is the weight (between 0 and 1) of each new latency in the
+	// average. If 0, DefaultEWMADecay is used.
+	Decay float64
+
+	// mu synchronizes access to latencies, the average latencies (by node).
+	mu        sync.Mutex
+	latencies map[string]float64
+}
+
+func (s *EWMASelector) Select(key string, nodes []string) []string {
+	s.mu.Lock()
+	latencies := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		latencies[node] = s.latencies[node]
+	}
+	s.mu.Unlock()
+
+	selected := append([]string(nil), nodes...)
+	sort.SliceStable(selected, func(i, j int) bool { return latencies[selected[i]] < latencies[selected[j]] })
+	return selected
+}
+
+func (s *EWMASelector) ObserveLatency(node string, latency time.Duration) {
+	decay := s.Decay
+	if decay == 0 {
+		decay = DefaultEWMADecay
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latencies == nil {
+		s.latencies = map[string]float64{}
+	}
+	if avg, ok := s.latencies[node]; ok {
+		s.latencies[node] = decay*float64(latency) + (1-decay)*avg
+	} else {
+		s.latencies[node] = float64(latency)
+	}
+}
+
+// LocalitySelector is a Selector that tries the nodes whose labels (see
+// Node.Labels) match all of its Labels (e.g., the nodes in the client's
+// zone) before the other nodes. Nodes' labels are looked up in their
+// published NodeInfo and cached for NodeInfoInterval.
+type LocalitySelector struct {
+	// Labels are the labels of the preferred nodes, such as
+	// {"zone": "us-east-1a"}.
+	Labels map[string]string
+
+	// Next orders the preferred nodes and the other nodes among themselves.
+	// If nil, OrderedSelector is used.
+	Next Selector
+
+	c *Client
+
+	// mu synchronizes access to cache, the labels (by node) of the nodes
+	// whose NodeInfo has been looked up.
+	mu    sync.Mutex
+	cache map[string]cachedLabels
+}
+
+type cachedLabels struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+// NewLocalitySelector returns a LocalitySelector that prefers nodes with
+// labels, and that looks up nodes' labels using c.
+func NewLocalitySelector(c *Client, labels map[string]string, next Selector) *LocalitySelector {
+	return &LocalitySelector{Labels: labels, Next: next, c: c}
+}
+
+func (s *LocalitySelector) Select(key string, nodes []string) []string {
+	if s.Next != nil {
+		nodes = s.Next.Select(key, nodes)
+	}
+	local := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		local[node] = s.matches(node)
+	}
+	selected := append([]string(nil), nodes...)
+	sort.SliceStable(selected, func(i, j int) bool { return local[selected[i]] && !local[selected[j]] })
+	return selected
+}
+
+func (s *LocalitySelector) ObserveLatency(node string, latency time.Duration) {
+	if o, ok := s.Next.(LatencyObserver); ok {
+		o.ObserveLatency(node, latency)
+	}
+}
+
+// matches reports whether node's labels match s.Labels. Nodes whose labels
+// can't be looked up don't match.
+func (s *LocalitySelector) matches(node string) bool {
+	labels := s.labels(node)
+	for k, v := range s.Labels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// labels returns node's labels (from the cache, if they were looked up in the
+// last NodeInfoInterval).
+func (s *LocalitySelector) labels(node string) map[string]string {
+	s.mu.Lock()
+	cached, ok := s.cache[node]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetched) < NodeInfoInterval {
+		return cached.labels
+	}
+
+	info, err := s.c.NodeInfo(node)
+	if err != nil && err != ErrKeyNotExist {
+		s.c.logf("Failed to look up labels of node %s: %s.", node, err)
+		return cached.labels
+	}
+	cached = cachedLabels{fetched: time.Now()}
+	if info != nil {
+		cached.labels = info.Labels
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = map[string]cachedLabels{}
+	}
+	s.cache[node] = cached
+	return cached.labels
+}
+
+func (c *Client) selector() Selector {
+	if c.Selector != nil {
+		return c.Selector
+	}
+	return OrderedSelector{}
+}
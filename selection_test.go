@@ -0,0 +1,127 @@
+package datad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRandomSelector(t *testing.T) {
+	nodes := []string{"a:80", "b:80", "c:80"}
+	first := map[string]int{}
+	for i := 0; i < 300; i++ {
+		got := RandomSelector{}.Select("k", nodes)
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, nodes) {
+			t.Fatalf("got Select == %v, want a permutation of %v", got, nodes)
+		}
+		first[got[0]]++
+	}
+	for _, node := range nodes {
+		if first[node] < 50 {
+			t.Errorf("node %s was selected first %d/300 times, want about 100", node, first[node])
+		}
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	var s RoundRobinSelector
+	nodes := []string{"a:80", "b:80", "c:80"}
+	want := [][]string{
+		{"a:80", "b:80", "c:80"},
+		{"b:80", "c:80", "a:80"},
+		{"c:80", "a:80", "b:80"},
+		{"a:80", "b:80", "c:80"},
+	}
+	for i, want := range want {
+		if got := s.Select("k", nodes); !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: got Select == %v, want %v", i, got, want)
+		}
+	}
+	if want := []string{"a:80", "b:80", "c:80"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Select modified its argument: got %v, want %v", nodes, want)
+	}
+}
+
+func TestEWMASelector(t *testing.T) {
+	s := &EWMASelector{Decay: 0.5}
+	nodes := []string{"a:80", "b:80", "c:80"}
+
+	s.ObserveLatency("a:80", 30*time.Millisecond)
+	s.ObserveLatency("b:80", 10*time.Millisecond)
+	// c:80 has no observed latency, so it is tried first.
+	if got, want := s.Select("k", nodes), []string{"c:80", "b:80", "a:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Select == %v, want %v", got, want)
+	}
+
+	s.ObserveLatency("c:80", 20*time.Millisecond)
+	s.ObserveLatency("b:80", 50*time.Millisecond) // average is now 30ms
+	if got, want := s.Select("k", nodes), []string{"c:80", "a:80", "b:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Select == %v, want %v", got, want)
+	}
+}
+
+func TestLocalitySelector(t *testing.T) {
+	b := NewMemoryBackend()
+	c := NewClient(b)
+	for node, zone := range map[string]string{"a:80": "east", "b:80": "west", "c:80": "east"} {
+		data, _ := json.Marshal(&NodeInfo{Labels: map[string]string{"zone": zone}})
+		must(t, b.Set(keyPathJoin(nodesPrefix, node, nodeInfoFile), string(data)))
+	}
+
+	s := NewLocalitySelector(c, map[string]string{"zone": "west"}, nil)
+	nodes := []string{"a:80", "b:80", "c:80", "d:80"}
+	if got, want := s.Select("k", nodes), []string{"b:80", "a:80", "c:80", "d:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Select == %v, want %v", got, want)
+	}
+
+	s = NewLocalitySelector(c, map[string]string{"zone": "east"}, &EWMASelector{})
+	s.ObserveLatency("a:80", 20*time.Millisecond)
+	s.ObserveLatency("b:80", 5*time.Millisecond)
+	s.ObserveLatency("c:80", 10*time.Millisecond)
+	s.ObserveLatency("d:80", 1*time.Millisecond)
+	if got, want := s.Select("k", nodes), []string{"c:80", "a:80", "d:80", "b:80"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Select == %v, want %v", got, want)
+	}
+}
+
+// Test that a KeyTransport spreads requests for a key across its nodes
+// according to the client's Selector.
+func TestKeyTransport_Selector(t *testing.T) {
+	c := NewClient(NewMemoryBackend())
+	c.Selector = &RoundRobinSelector{}
+
+	counts := map[string]int{}
+	for i := 0; i < 2; i++ {
+		var node string
+		ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { counts[node]++ }))
+		defer ds.Close()
+		node = cleanNodeName(ds.URL)
+		must(t, c.registry.add("k", node, RegistrationStatus{State: StateReady}, ReasonAssigned))
+	}
+
+	transport, err := c.TransportForKey("k", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		resp, err := (&http.Client{Transport: transport}).Get("/k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(counts) != 2 {
+		t.Fatalf("got requests to %d nodes (%v), want 2", len(counts), counts)
+	}
+	for node, n := range counts {
+		if n != 2 {
+			t.Errorf("got %d requests to node %s, want 2", n, node)
+		}
+	}
+}